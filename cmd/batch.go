@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/image"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/vmexport"
+)
+
+type batchResult struct {
+	exportSource vmexport.ExportSource
+	duration     time.Duration
+	err          error
+}
+
+// runBatch exports every source matching the selector, up to concurrency at a time,
+// and fails if any of them failed.
+func runBatch(ctx context.Context, opts RunOptions) error {
+	if opts.concurrency < 1 {
+		return fmt.Errorf("invalid concurrency: %d, must be at least 1", opts.concurrency)
+	}
+
+	if !strings.Contains(opts.imageDestination, image.SourceNamePlaceholder) {
+		return fmt.Errorf("image destination must contain '%s' when exporting by selector", image.SourceNamePlaceholder)
+	}
+
+	// Sources with the same name in different namespaces would overwrite each other's image.
+	if opts.allNamespaces && !strings.Contains(opts.imageDestination, image.SourceNamespacePlaceholder) {
+		return fmt.Errorf("image destination must contain '%s' when exporting from all namespaces", image.SourceNamespacePlaceholder)
+	}
+
+	namespace := opts.exportSourceNamespace
+	if opts.allNamespaces {
+		namespace = ""
+	}
+
+	log.Printf("Listing export sources of kind '%s' matching '%s'...", opts.exportSourceKind, opts.selector)
+
+	exportSources, err := vmexport.ListExportSources(opts.client, opts.exportSourceKind, namespace, opts.selector)
+	if err != nil {
+		return err
+	}
+
+	if len(exportSources) == 0 {
+		return fmt.Errorf("no export source of kind '%s' matches selector '%s'", opts.exportSourceKind, opts.selector)
+	}
+
+	log.Printf("Exporting %d sources, %d at a time...", len(exportSources), opts.concurrency)
+
+	results := make([]batchResult, len(exportSources))
+	semaphore := make(chan struct{}, opts.concurrency)
+	var wg sync.WaitGroup
+	for i, exportSource := range exportSources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i] = runBatchItem(ctx, opts, exportSource)
+		}()
+	}
+	wg.Wait()
+
+	printBatchSummary(log.Writer(), results)
+
+	failed := 0
+	for _, result := range results {
+		if result.err != nil {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d exports failed", failed, len(results))
+	}
+	return nil
+}
+
+// runBatchItem runs the export of a single source in its own scratch directory,
+// so concurrent exports don't overwrite each other's disk.
+func runBatchItem(ctx context.Context, opts RunOptions, exportSource vmexport.ExportSource) (result batchResult) {
+	result.exportSource = exportSource
+	if err := ctx.Err(); err != nil {
+		result.err = err
+		return result
+	}
+
+	log.Printf("Exporting '%s/%s'...", exportSource.Namespace, exportSource.Name)
+
+	opts.exportSourceNamespace = exportSource.Namespace
+	opts.exportSourceName = exportSource.Name
+	opts.scratchDir = filepath.Join(opts.scratchDir, fmt.Sprintf("%s-%s", exportSource.Namespace, exportSource.Name))
+
+	start := time.Now()
+	defer func() { result.duration = time.Since(start) }()
+
+	if err := os.MkdirAll(opts.scratchDir, 0755); err != nil {
+		result.err = err
+		return result
+	}
+
+	result.err = run(ctx, opts)
+	if result.err != nil {
+		// The scratch directory is kept, so a rerun resumes the download of the source.
+		log.Printf("Failed to export '%s/%s': %v", exportSource.Namespace, exportSource.Name, result.err)
+		return result
+	}
+
+	if err := os.RemoveAll(opts.scratchDir); err != nil {
+		log.Printf("Failed to remove scratch directory '%s': %v", opts.scratchDir, err)
+	}
+	return result
+}
+
+func printBatchSummary(w io.Writer, results []batchResult) {
+	writer := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "NAMESPACE\tNAME\tRESULT\tDURATION\tERROR")
+	for _, result := range results {
+		status, message := "Succeeded", ""
+		if result.err != nil {
+			status, message = "Failed", result.err.Error()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\n",
+			result.exportSource.Namespace, result.exportSource.Name, status, result.duration.Round(time.Second), message)
+	}
+	writer.Flush()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/disk"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/vmexport"
+)
+
+const (
+	downloaderNbdkit string = "nbdkit"
+	downloaderNative string = "native"
+
+	downloadFormatRaw  string = "raw"
+	downloadFormatGzip string = "gzip"
+)
+
+// diskDownloader downloads the disks of a run from the VirtualMachineExport server.
+type diskDownloader struct {
+	downloader     string
+	downloadFormat string
+	kvExportToken  string
+	caPath         string
+	resolve        string
+	httpClient     *http.Client
+	// exportSource identifies the source of the disks across runs, so an interrupted
+	// download of the same disk is resumed.
+	exportSource string
+	retries      int
+	workers      int
+	segmentSize  int64
+	// convertOptions are the format and options of the disk in the image.
+	convertOptions disk.ConvertOptions
+}
+
+func validateDownloader(downloader, downloadFormat string, downloadRetries, downloadWorkers, segmentSize int) error {
+	if downloader != downloaderNbdkit && downloader != downloaderNative {
+		return fmt.Errorf("invalid downloader: %s, must be one of nbdkit, native", downloader)
+	}
+
+	if downloadFormat != downloadFormatRaw && downloadFormat != downloadFormatGzip {
+		return fmt.Errorf("invalid download-format: %s, must be one of raw, gzip", downloadFormat)
+	}
+
+	if downloadFormat == downloadFormatGzip && downloader != downloaderNative {
+		return fmt.Errorf("download-format gzip can be used only with the native downloader")
+	}
+
+	if downloadRetries < 0 {
+		return fmt.Errorf("invalid download-retries: %d, must be at least 0", downloadRetries)
+	}
+
+	if downloadWorkers < 1 {
+		return fmt.Errorf("invalid download-workers: %d, must be at least 1", downloadWorkers)
+	}
+
+	if segmentSize < 1 {
+		return fmt.Errorf("invalid segment-size: %d, must be at least 1", segmentSize)
+	}
+
+	if downloadWorkers > 1 && (downloader != downloaderNative || downloadFormat != downloadFormatRaw) {
+		return fmt.Errorf("download-workers can be used only with the native downloader and the raw download format")
+	}
+	return nil
+}
+
+// download downloads the disk to diskPath in the disk format, and returns the digest of the raw
+// disk, which is known only with the native downloader.
+func (d *diskDownloader) download(ctx context.Context, rawDiskUrl vmexport.RawDiskUrl, diskPath string) (string, error) {
+	log.Printf("Downloading disk image of volume '%s' from the VirtualMachineExport server...", rawDiskUrl.VolumeName)
+
+	name := fmt.Sprintf("%s/%s", d.exportSource, rawDiskUrl.VolumeName)
+
+	var sourceDigest string
+	var err error
+	if d.downloader == downloaderNative {
+		sourceDigest, err = d.downloadNative(ctx, rawDiskUrl, name, diskPath)
+	} else {
+		// nbdkit streams the raw disk straight into qemu-img, so there's no raw disk
+		// to compute the source digest of.
+		reporter := progress.Start(progress.PhaseDownload, name, 0)
+
+		// qemu-img reports the progress as percentage only, which is converted to bytes
+		// with the size of the disk.
+		if size, err := disk.GetDiskSize(ctx, d.httpClient, rawDiskUrl.Url, kvExportTokenHeader, d.kvExportToken); err == nil {
+			reporter.SetTotal(size)
+		} else {
+			log.Printf("Failed to get size of disk, reporting the progress as percentage: %v", err)
+		}
+
+		err = disk.DownloadDiskImageFromURL(ctx, rawDiskUrl.Url, kvExportTokenHeader, d.kvExportToken, d.caPath, d.resolve, diskPath, d.convertOptions, reporter)
+		reporter.Stop()
+	}
+
+	if err != nil {
+		os.Remove(diskPath)
+		return "", err
+	}
+	return sourceDigest, nil
+}
+
+// downloadNative downloads the raw disk next to the disk, and converts it. The raw
+// download is resumed from the state file next to it, so the raw disk and its state are
+// kept when the download or the conversion fails, and removed once converted.
+// The name identifies the disk across runs, for the state file and the progress. The
+// digest of the raw disk is computed while it's converted.
+func (d *diskDownloader) downloadNative(ctx context.Context, rawDiskUrl vmexport.RawDiskUrl, name, diskPath string) (string, error) {
+	rawDiskPath := fmt.Sprintf("%s.raw", diskPath)
+
+	if d.downloadFormat == downloadFormatGzip {
+		defer os.Remove(rawDiskPath)
+
+		if rawDiskUrl.GzipUrl == "" {
+			return "", fmt.Errorf("volume '%s' is not exported in gzip format", rawDiskUrl.VolumeName)
+		}
+	}
+
+	reporter := progress.Start(progress.PhaseDownload, name, 0)
+
+	var err error
+	switch {
+	case d.downloadFormat == downloadFormatGzip:
+		err = disk.DownloadRawDiskImage(ctx, d.httpClient, rawDiskUrl.GzipUrl, true, kvExportTokenHeader, d.kvExportToken, rawDiskPath, reporter)
+	case d.workers > 1:
+		err = disk.DownloadRawDiskImageSegments(ctx, d.httpClient, rawDiskUrl.Url, kvExportTokenHeader, d.kvExportToken, rawDiskPath, name, d.retries, d.workers, d.segmentSize, reporter)
+	default:
+		err = disk.ResumeRawDiskImage(ctx, d.httpClient, rawDiskUrl.Url, kvExportTokenHeader, d.kvExportToken, rawDiskPath, name, d.retries, reporter)
+	}
+
+	reporter.Stop()
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Converting disk image to %s...", d.convertOptions.Format)
+
+	var sourceDigest string
+	var digestErr error
+	digestDone := make(chan struct{})
+	go func() {
+		defer close(digestDone)
+		sourceDigest, digestErr = disk.GetDigest(rawDiskPath)
+	}()
+
+	reporter = progress.Start(progress.PhaseConversion, name, 0)
+	err = disk.ConvertDiskImage(ctx, rawDiskPath, diskPath, d.convertOptions, reporter)
+	reporter.Stop()
+	<-digestDone
+	if err != nil {
+		return "", err
+	}
+	if digestErr != nil {
+		return "", digestErr
+	}
+
+	os.Remove(rawDiskPath)
+	os.Remove(disk.GetStatePath(rawDiskPath))
+	return sourceDigest, nil
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"os"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/volumes"
+
+	cobra "github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func newListVolumesCommand(clientConfig clientcmd.ClientConfig, opts *RunOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "list-volumes",
+		Short: "Lists the volumes the export of the source will expose, to use with --volumename",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := setup(clientConfig, opts); err != nil {
+				return err
+			}
+
+			exportVolumes, err := volumes.ListVolumes(opts.client, opts.exportSourceKind, opts.exportSourceNamespace, opts.exportSourceName)
+			if err != nil {
+				cmd.SilenceUsage = true
+				return err
+			}
+			return volumes.PrintVolumes(os.Stdout, exportVolumes)
+		},
+	}
+}
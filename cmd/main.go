@@ -1,23 +1,49 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/codingben/kubevirt-disk-uploader/pkg/certificate"
 	"github.com/codingben/kubevirt-disk-uploader/pkg/disk"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/httpclient"
 	"github.com/codingben/kubevirt-disk-uploader/pkg/image"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/lease"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/manifests"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/portforward"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/preflight"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/redact"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/runstate"
 	"github.com/codingben/kubevirt-disk-uploader/pkg/secrets"
 	"github.com/codingben/kubevirt-disk-uploader/pkg/vmexport"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/vmsnapshot"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/volumesnapshot"
 
 	cobra "github.com/spf13/cobra"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/clientcmd"
 	kubecli "kubevirt.io/client-go/kubecli"
 )
 
 const (
-	diskPath            string = "./tmp/disk.qcow2"
-	certificatePath     string = "./tmp/tls.crt"
+	scratchDir          string = "./tmp"
+	diskFileName        string = "disk"
 	kvExportTokenHeader string = "x-kubevirt-export-token"
+	runIDLength         int    = 5
+
+	onExistingReuse   string = "reuse"
+	onExistingReplace string = "replace"
+	onExistingFail    string = "fail"
 )
 
 type RunOptions struct {
@@ -26,118 +52,804 @@ type RunOptions struct {
 	exportSourceNamespace string
 	exportSourceName      string
 	volumeName            string
+	allVolumes            bool
 	imageDestination      string
 	pushTimeout           int
+	onExisting            string
+	keepExport            bool
+	exportTTL             int
+	link                  string
+	portForward           bool
+	manifests             bool
+	snapshotFirst         bool
+	keepSnapshot          bool
+	stopVM                bool
+	skipPreflight         bool
+	selector              string
+	allNamespaces         bool
+	concurrency           int
+	owner                 string
+	caBundle              string
+	lockTimeout           int
+	downloader            string
+	requireSourceDigest   bool
+	downloadFormat        string
+	downloadRetries       int
+	downloadWorkers       int
+	segmentSize           int
+	progressInterval      int
+	diskFormat            string
+	compression           string
+	clusterSize           string
+	sparseSize            string
+	progressJSON          string
+	scratchDir            string
 }
 
-func run(opts RunOptions) error {
+func run(ctx context.Context, opts RunOptions) error {
 	client := opts.client
-	kind := opts.exportSourceKind
-	name := opts.exportSourceName
-	namespace := opts.exportSourceNamespace
 	volumeName := opts.volumeName
 	imageDestination := opts.imageDestination
 	imagePushTimeout := opts.pushTimeout
+	convertOptions := disk.ConvertOptions{
+		Format:      opts.diskFormat,
+		Compression: opts.compression,
+		ClusterSize: opts.clusterSize,
+		SparseSize:  opts.sparseSize,
+	}
+
+	if opts.onExisting != onExistingReuse && opts.onExisting != onExistingReplace && opts.onExisting != onExistingFail {
+		return fmt.Errorf("invalid on-existing: %s, must be one of reuse, replace, fail", opts.onExisting)
+	}
+
+	if volumeName == "" && !opts.allVolumes && !vmexport.HasDefaultVolumeName(opts.exportSourceKind) {
+		return fmt.Errorf("volume name must be set for export source kind '%s'", opts.exportSourceKind)
+	}
+
+	if opts.allVolumes && !strings.Contains(imageDestination, image.VolumePlaceholder) {
+		return fmt.Errorf("image destination must contain '%s' when exporting all volumes", image.VolumePlaceholder)
+	}
+
+	if opts.snapshotFirst && !vmexport.IsVirtualMachineSource(opts.exportSourceKind) {
+		return fmt.Errorf("snapshot-first can be used only with export source kind 'vm'")
+	}
+
+	if opts.stopVM && !vmexport.IsVirtualMachineSource(opts.exportSourceKind) {
+		return fmt.Errorf("stop-vm can be used only with export source kind 'vm'")
+	}
+
+	// Only exports of VMs and VM snapshots have manifests.
+	if opts.manifests && !vmexport.IsVirtualMachineSource(opts.exportSourceKind) && !vmexport.IsVirtualMachineSnapshotSource(opts.exportSourceKind) {
+		return fmt.Errorf("manifests can be used only with export source kind 'vm' or 'vmsnapshot'")
+	}
+
+	link, err := vmexport.ResolveLink(opts.link)
+	if err != nil {
+		return err
+	}
+
+	if opts.portForward {
+		if opts.link == vmexport.LinkExternal {
+			return fmt.Errorf("port-forward can't be used with the external link")
+		}
+		link = vmexport.LinkInternal
+	}
 
-	log.Printf("Creating a new Secret '%s/%s' object...", namespace, name)
+	if err := convertOptions.Validate(); err != nil {
+		return err
+	}
 
-	if err := secrets.CreateVirtualMachineExportSecret(client, namespace, name); err != nil {
+	if err := validateDownloader(opts.downloader, opts.downloadFormat, opts.downloadRetries, opts.downloadWorkers, opts.segmentSize); err != nil {
 		return err
 	}
 
-	log.Printf("Creating a new VirtualMachineExport '%s/%s' object...", namespace, name)
+	// nbdkit streams the raw disk straight into qemu-img, so the source digest is known
+	// only with the native downloader.
+	if opts.requireSourceDigest && opts.downloader != downloaderNative {
+		return fmt.Errorf("require-source-digest can be used only with the native downloader")
+	}
+
+	caBundle, err := certificate.ReadCABundle(opts.caBundle)
+	if err != nil {
+		return err
+	}
+
+	if !opts.skipPreflight {
+		log.Println("Running preflight checks...")
+
+		checks := preflight.Run(client, getPreflightOptions(opts))
+		preflight.PrintReport(log.Writer(), checks)
+
+		if !preflight.Passed(checks) {
+			return fmt.Errorf("preflight checks failed")
+		}
+	}
+
+	// The run ID makes the names of the created objects unique, and links them to the run.
+	runID := utilrand.String(runIDLength)
+	log.Printf("Starting run '%s'...", runID)
+
+	owner, err := ownerreference.GetOwner(client, opts.owner, opts.exportSourceNamespace, runID)
+	if err != nil {
+		return err
+	}
+
+	if owner.Reference == nil {
+		log.Println("No owner found, created objects are deleted by the run only.")
+	}
+
+	// A crashed run leaves its VM stopped, so runs with permissions to restore VMs restore
+	// the VMs of the namespace no other run holds.
+	if opts.stopVM {
+		restoreStoppedVirtualMachines(ctx, client, opts.exportSourceNamespace, opts.exportSourceName, runID, owner)
+	}
+
+	log.Printf("Resolving export source '%s/%s'...", opts.exportSourceNamespace, opts.exportSourceName)
+
+	kind, namespace, name, err := vmexport.ResolveExportSource(client, opts.exportSourceKind, opts.exportSourceNamespace, opts.exportSourceName)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Locking export source '%s/%s'...", namespace, name)
+
+	lock, err := lease.AcquireLock(ctx, client, namespace, kind, name, getLockHolder(runID), owner, time.Minute*time.Duration(opts.lockTimeout))
+	if err != nil {
+		return err
+	}
+	defer releaseLock(lock, namespace, name)
+
+	var snapshotVolumeName string
+	if vmexport.IsVolumeSnapshotSource(kind) {
+		snapshotVolumeName = volumesnapshot.GetVolumeName(name)
+
+		pvcName, err := handleExistingPersistentVolumeClaim(client, opts.onExisting, namespace, name)
+		if err != nil {
+			return err
+		}
+
+		if pvcName != "" {
+			kind, name = vmexport.GetRestoredVolumeSnapshotSource(pvcName)
+		} else {
+			log.Printf("Creating a new PersistentVolumeClaim from VolumeSnapshot '%s/%s'...", namespace, name)
+
+			kind, name, err = vmexport.RestoreVolumeSnapshotSource(client, namespace, name, owner)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !opts.keepExport {
+			defer deletePersistentVolumeClaim(client, namespace, name)
+		}
+	}
+
+	if opts.snapshotFirst {
+		log.Printf("Creating a new VirtualMachineSnapshot of VirtualMachine '%s/%s'...", namespace, name)
 
-	if err := vmexport.CreateVirtualMachineExport(client, kind, namespace, name); err != nil {
+		vmSnapshotName, err := vmsnapshot.CreateVirtualMachineSnapshot(client, namespace, name, owner)
+		if err != nil {
+			return err
+		}
+
+		// A kept export still refers to the snapshot, so it's kept as well.
+		if !opts.keepExport && !opts.keepSnapshot {
+			defer deleteVirtualMachineSnapshot(client, namespace, vmSnapshotName)
+		}
+
+		log.Printf("Waiting for VirtualMachineSnapshot '%s/%s' to be ready...", namespace, vmSnapshotName)
+
+		if err := vmsnapshot.WaitUntilVirtualMachineSnapshotReady(ctx, client, namespace, vmSnapshotName); err != nil {
+			return err
+		}
+
+		kind, name = vmexport.GetVirtualMachineSnapshotSource(vmSnapshotName)
+	}
+
+	// The VM is restored as soon as the export is deleted, or when the run fails or gets
+	// terminated before that. A crashed run leaves the original state in an annotation.
+	restoreVirtualMachine := func() {}
+	if opts.stopVM {
+		var once sync.Once
+		vmNamespace, vmName := namespace, name
+		restoreVirtualMachine = func() {
+			once.Do(func() { restoreRunState(client, vmNamespace, vmName) })
+		}
+		defer restoreVirtualMachine()
+
+		log.Printf("Stopping VirtualMachine '%s/%s'...", namespace, name)
+
+		if err := runstate.StopVirtualMachine(client, namespace, name); err != nil {
+			return err
+		}
+
+		log.Println("Waiting for VirtualMachineInstance to be deleted...")
+
+		if err := runstate.WaitUntilVirtualMachineStopped(ctx, client, namespace, name); err != nil {
+			return err
+		}
+	}
+
+	// The volume restored from a VolumeSnapshot is exported under the name of the PVC.
+	if snapshotVolumeName != "" && volumeName == snapshotVolumeName {
+		volumeName = name
+	}
+
+	if volumeName == "" && !opts.allVolumes {
+		volumeName = vmexport.GetDefaultVolumeName(kind, name)
+	}
+
+	exportName, err := handleExistingExport(ctx, client, opts.onExisting, kind, namespace, name)
+	if err != nil {
 		return err
 	}
 
+	reuse := exportName != ""
+	if !reuse {
+		exportName = vmexport.GetExportName(name, runID)
+	}
+
+	// The export keeps the source locked, so it's deleted as soon as every disk is
+	// downloaded, or when the run fails or gets terminated before that.
+	cleanupExport := func() {}
+	if !opts.keepExport {
+		var once sync.Once
+		cleanupExport = func() {
+			once.Do(func() { deleteVirtualMachineExport(client, namespace, exportName) })
+		}
+	}
+	defer cleanupExport()
+
+	if !reuse {
+		log.Printf("Creating a new Secret '%s/%s' object...", namespace, exportName)
+
+		if err := secrets.CreateVirtualMachineExportSecret(client, namespace, exportName, owner); err != nil {
+			return err
+		}
+
+		log.Printf("Creating a new VirtualMachineExport '%s/%s' object...", namespace, exportName)
+
+		if err := vmexport.CreateVirtualMachineExport(client, kind, namespace, name, exportName, time.Minute*time.Duration(opts.exportTTL), owner); err != nil {
+			return err
+		}
+	}
+
 	log.Println("Waiting for VirtualMachineExport status to be ready...")
 
-	if err := vmexport.WaitUntilVirtualMachineExportReady(client, namespace, name); err != nil {
+	if err := vmexport.WaitUntilVirtualMachineExportReady(ctx, client, namespace, exportName); err != nil {
 		return err
 	}
 
 	log.Println("Getting raw disk URL from the VirtualMachineExport object status...")
 
-	rawDiskUrl, err := vmexport.GetRawDiskUrlFromVolumes(client, namespace, name, volumeName)
+	rawDiskUrls, err := getRawDiskUrls(client, namespace, exportName, volumeName, link, opts.allVolumes)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Creating TLS certificate file from the VirtualMachineExport object status...")
+	// The PVC restored from a VolumeSnapshot is named after the run, so the volume keeps
+	// the name of the snapshot, e.g. for the image destination and resumed downloads.
+	if snapshotVolumeName != "" {
+		for i := range rawDiskUrls {
+			rawDiskUrls[i].VolumeName = snapshotVolumeName
+		}
+	}
 
-	certificateData, err := certificate.GetCertificateFromVirtualMachineExport(client, namespace, name)
+	log.Println("Getting TLS certificate from the VirtualMachineExport object status...")
+
+	certificateData, err := certificate.GetCertificateFromVirtualMachineExport(client, namespace, exportName, link)
 	if err != nil {
 		return err
 	}
 
-	if err := certificate.CreateCertificateFile(certificatePath, certificateData); err != nil {
+	certificateBundle := certificate.GetCertificateBundle(certificateData, caBundle)
+	certPool, err := certificate.GetCertPool(certificateBundle)
+	if err != nil {
 		return err
 	}
 
+	// nbdkit reads the certificates from a file only, which is removed once the run ends.
+	caPath := ""
+	if opts.downloader == downloaderNbdkit && len(certificateBundle) > 0 {
+		caPath, err = certificate.CreateCertificateFile(opts.scratchDir, certificateBundle)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(caPath)
+	}
+
 	log.Println("Getting export token from the Secret object...")
 
-	kvExportToken, err := secrets.GetTokenFromVirtualMachineExportSecret(client, namespace, name)
+	kvExportToken, err := secrets.GetTokenFromVirtualMachineExportSecret(client, namespace, exportName)
 	if err != nil {
 		return err
 	}
+	redact.Add(kvExportToken)
+
+	resolve := ""
+	var localPort uint16
+	if opts.portForward {
+		log.Println("Opening a port-forward to the VirtualMachineExport server...")
+
+		stopChan := make(chan struct{})
+		defer close(stopChan)
+
+		localPort, err = portforward.ForwardExportServer(client, namespace, exportName, stopChan)
+		if err != nil {
+			return err
+		}
 
-	log.Println("Downloading disk image from the VirtualMachineExport server...")
+		for i := range rawDiskUrls {
+			rawDiskUrls[i].Url, resolve, err = portforward.GetForwardedUrl(rawDiskUrls[i].Url, localPort)
+			if err != nil {
+				return err
+			}
 
-	if err := disk.DownloadDiskImageFromURL(rawDiskUrl, kvExportTokenHeader, kvExportToken, certificatePath, diskPath); err != nil {
+			if rawDiskUrls[i].GzipUrl != "" {
+				rawDiskUrls[i].GzipUrl, _, err = portforward.GetForwardedUrl(rawDiskUrls[i].GzipUrl, localPort)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	httpClient, err := httpclient.NewClient(certPool, resolve)
+	if err != nil {
 		return err
 	}
 
+	// The downloads are keyed by the source passed to the run, not by the PVC restored or
+	// the snapshot taken by the run, whose names change with every run.
+	downloader := &diskDownloader{
+		downloader:     opts.downloader,
+		downloadFormat: opts.downloadFormat,
+		kvExportToken:  kvExportToken,
+		caPath:         caPath,
+		resolve:        resolve,
+		httpClient:     httpClient,
+		exportSource:   fmt.Sprintf("%s/%s/%s", opts.exportSourceKind, opts.exportSourceNamespace, opts.exportSourceName),
+		retries:        opts.downloadRetries,
+		workers:        opts.downloadWorkers,
+		segmentSize:    int64(opts.segmentSize) * 1024 * 1024,
+		convertOptions: convertOptions,
+	}
+
+	imageDestinations := map[string]string{}
+	for _, rawDiskUrl := range rawDiskUrls {
+		imageDestinations[rawDiskUrl.VolumeName] = image.GetImageDestination(imageDestination, opts.exportSourceNamespace, opts.exportSourceName, rawDiskUrl.VolumeName)
+	}
+
+	var vmManifests []byte
+	if opts.manifests {
+		log.Println("Downloading manifests from the VirtualMachineExport server...")
+
+		manifestUrl, err := vmexport.GetManifestUrl(client, namespace, exportName, link)
+		if err != nil {
+			return err
+		}
+
+		if opts.portForward {
+			manifestUrl, _, err = portforward.GetForwardedUrl(manifestUrl, localPort)
+			if err != nil {
+				return err
+			}
+		}
+
+		vmManifests, err = manifests.DownloadManifests(ctx, httpClient, manifestUrl, kvExportTokenHeader, kvExportToken)
+		if err != nil {
+			return err
+		}
+
+		vmManifests, err = manifests.RewriteVolumes(vmManifests, imageDestinations)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Every disk is downloaded before any is pushed, so the export is deleted and the VM
+	// restored as soon as possible, at the cost of scratch space for all disks at once.
+	diskPaths := make([]string, len(rawDiskUrls))
+	sourceDigests := make([]string, len(rawDiskUrls))
+	for i, rawDiskUrl := range rawDiskUrls {
+		diskPaths[i] = filepath.Join(opts.scratchDir, fmt.Sprintf("%s-%s.%s", diskFileName, rawDiskUrl.VolumeName, opts.diskFormat))
+		defer os.Remove(diskPaths[i])
+
+		sourceDigests[i], err = downloader.download(ctx, rawDiskUrl, diskPaths[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	cleanupExport()
+	restoreVirtualMachine()
+
+	for i, rawDiskUrl := range rawDiskUrls {
+		destination := imageDestinations[rawDiskUrl.VolumeName]
+		if err := uploadDisk(ctx, diskPaths[i], sourceDigests[i], destination, imagePushTimeout, vmManifests); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Successfully uploaded to the container registry.")
+	return nil
+}
+
+// handleExistingExport applies the on-existing policy to the VirtualMachineExports and
+// Secrets of the source left behind by previous runs, and returns the name of the one
+// to reuse, if any. The source is locked, so no other run is using them.
+func handleExistingExport(ctx context.Context, client kubecli.KubevirtClient, onExisting, kind, namespace, name string) (string, error) {
+	vmExports, err := vmexport.ListVirtualMachineExports(client, kind, namespace, name)
+	if err != nil {
+		return "", err
+	}
+
+	if len(vmExports) == 0 {
+		return "", nil
+	}
+
+	switch onExisting {
+	case onExistingFail:
+		return "", fmt.Errorf("VirtualMachineExport '%s/%s' of the source already exists, use --on-existing=reuse|replace", namespace, vmExports[0].Name)
+	case onExistingReuse:
+		for _, vmExport := range vmExports {
+			secretExists, err := secrets.VirtualMachineExportSecretExists(client, namespace, vmExport.Name)
+			if err != nil {
+				return "", err
+			}
+
+			if vmExport.DeletionTimestamp == nil && secretExists {
+				log.Printf("Reusing existing VirtualMachineExport '%s/%s'...", namespace, vmExport.Name)
+				return vmExport.Name, nil
+			}
+		}
+
+		// Without its Secret the export token can't be trusted, so start over.
+		log.Printf("No reusable VirtualMachineExport of '%s/%s' found, creating a new one...", namespace, name)
+	}
+
+	for _, vmExport := range vmExports {
+		log.Printf("Deleting existing VirtualMachineExport and Secret '%s/%s'...", namespace, vmExport.Name)
+
+		if err := secrets.DeleteVirtualMachineExportSecret(client, namespace, vmExport.Name); err != nil {
+			return "", err
+		}
+
+		if err := vmexport.DeleteVirtualMachineExport(client, namespace, vmExport.Name); err != nil {
+			return "", err
+		}
+
+		// The source can't be exported again until the replaced export is gone.
+		if err := vmexport.WaitUntilVirtualMachineExportDeleted(ctx, client, namespace, vmExport.Name); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// handleExistingPersistentVolumeClaim applies the on-existing policy to the PVCs restored
+// from the VolumeSnapshot by previous runs, and returns the name of the one to reuse, if
+// any. Only PVCs created by the uploader are listed, so a PVC of the user is never reused
+// or deleted.
+func handleExistingPersistentVolumeClaim(client kubecli.KubevirtClient, onExisting, namespace, snapshotName string) (string, error) {
+	pvcs, err := volumesnapshot.ListPersistentVolumeClaims(client, namespace, snapshotName)
+	if err != nil {
+		return "", err
+	}
+
+	if len(pvcs) == 0 {
+		return "", nil
+	}
+
+	switch onExisting {
+	case onExistingFail:
+		return "", fmt.Errorf("PersistentVolumeClaim '%s/%s' restored from the VolumeSnapshot already exists, use --on-existing=reuse|replace", namespace, pvcs[0].Name)
+	case onExistingReuse:
+		for _, pvc := range pvcs {
+			if pvc.DeletionTimestamp == nil {
+				log.Printf("Reusing existing PersistentVolumeClaim '%s/%s'...", namespace, pvc.Name)
+				return pvc.Name, nil
+			}
+		}
+	}
+
+	for _, pvc := range pvcs {
+		log.Printf("Deleting existing PersistentVolumeClaim '%s/%s'...", namespace, pvc.Name)
+
+		if err := volumesnapshot.DeletePersistentVolumeClaim(client, namespace, pvc.Name); err != nil {
+			return "", err
+		}
+	}
+	return "", nil
+}
+
+// getLockHolder identifies the run holding the lock of the source, by the host (the
+// pod of the uploader) and the run ID.
+func getLockHolder(runID string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return runID
+	}
+	return fmt.Sprintf("%s/%s", hostname, runID)
+}
+
+func releaseLock(lock *lease.Lock, namespace, name string) {
+	log.Printf("Unlocking export source '%s/%s'...", namespace, name)
+
+	if err := lock.Release(); err != nil {
+		log.Printf("Failed to unlock export source '%s/%s': %v", namespace, name, err)
+	}
+}
+
+// deleteVirtualMachineExport deletes the token Secret first and doesn't wait for the
+// export to be gone, so both are deleted within the grace period of a terminated pod.
+func deleteVirtualMachineExport(client kubecli.KubevirtClient, namespace, name string) {
+	log.Printf("Deleting Secret and VirtualMachineExport '%s/%s'...", namespace, name)
+
+	if err := secrets.DeleteVirtualMachineExportSecret(client, namespace, name); err != nil {
+		log.Printf("Failed to delete Secret '%s/%s': %v", namespace, name, err)
+	}
+
+	if err := vmexport.DeleteVirtualMachineExport(client, namespace, name); err != nil {
+		log.Printf("Failed to delete VirtualMachineExport '%s/%s': %v", namespace, name, err)
+	}
+}
+
+func restoreRunState(client kubecli.KubevirtClient, namespace, name string) {
+	log.Printf("Restoring run state of VirtualMachine '%s/%s'...", namespace, name)
+
+	if err := runstate.RestoreVirtualMachine(client, namespace, name); err != nil {
+		log.Printf("Failed to restore run state of VirtualMachine '%s/%s', rerun with --stop-vm to restore it: %v", namespace, name, err)
+	}
+}
+
+// restoreStoppedVirtualMachines restores the VMs left stopped by crashed runs. A VM is
+// restored only while this run holds its Lease, so a live run exporting it is never
+// disturbed. The VM of this run is skipped, as it's restored after its export.
+func restoreStoppedVirtualMachines(ctx context.Context, client kubecli.KubevirtClient, namespace, sourceName, runID string, owner *ownerreference.Owner) {
+	names, err := runstate.ListStoppedVirtualMachines(client, namespace)
+	if err != nil {
+		log.Printf("Failed to list stopped VirtualMachines in namespace '%s': %v", namespace, err)
+		return
+	}
+
+	for _, name := range names {
+		if name == sourceName {
+			continue
+		}
+
+		kind, _ := vmexport.GetVirtualMachineSource(name)
+		lock, err := lease.AcquireLock(ctx, client, namespace, kind, name, getLockHolder(runID), owner, 0)
+		if err != nil {
+			log.Printf("Skipping stopped VirtualMachine '%s/%s': %v", namespace, name, err)
+			continue
+		}
+
+		restoreRunState(client, namespace, name)
+		releaseLock(lock, namespace, name)
+	}
+}
+
+func deleteVirtualMachineSnapshot(client kubecli.KubevirtClient, namespace, name string) {
+	log.Printf("Deleting VirtualMachineSnapshot '%s/%s'...", namespace, name)
+
+	if err := vmsnapshot.DeleteVirtualMachineSnapshot(client, namespace, name); err != nil {
+		log.Printf("Failed to delete VirtualMachineSnapshot '%s/%s': %v", namespace, name, err)
+	}
+}
+
+func deletePersistentVolumeClaim(client kubecli.KubevirtClient, namespace, name string) {
+	log.Printf("Deleting PersistentVolumeClaim '%s/%s'...", namespace, name)
+
+	if err := volumesnapshot.DeletePersistentVolumeClaim(client, namespace, name); err != nil {
+		log.Printf("Failed to delete PersistentVolumeClaim '%s/%s': %v", namespace, name, err)
+	}
+}
+
+func getRawDiskUrls(client kubecli.KubevirtClient, namespace, name, volumeName, link string, allVolumes bool) ([]vmexport.RawDiskUrl, error) {
+	if allVolumes {
+		return vmexport.GetRawDiskUrlsFromVolumes(client, namespace, name, link)
+	}
+
+	rawDiskUrl, err := vmexport.GetRawDiskUrlFromVolumes(client, namespace, name, volumeName, link)
+	if err != nil {
+		return nil, err
+	}
+	return []vmexport.RawDiskUrl{rawDiskUrl}, nil
+}
+
+// uploadDisk pushes the disk with its checksum as shasum label by digest, and tags it
+// only once the disk pushed is verified to match it, so the tag never points to a disk
+// that changed on the scratch space.
+func uploadDisk(ctx context.Context, diskPath, sourceDigest, imageDestination string, imagePushTimeout int, vmManifests []byte) error {
+	defer os.Remove(diskPath)
+
 	log.Println("Building a new container image...")
 
-	containerImage, err := image.Build(diskPath)
+	containerImage, err := image.Build(diskPath, sourceDigest)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Pushing new container image to the container registry...")
+	log.Printf("Checksum of disk image is %s", containerImage.Checksum)
 
-	if err := image.Push(containerImage, imageDestination, imagePushTimeout); err != nil {
+	log.Printf("Pushing new container image to '%s'...", imageDestination)
+
+	reporter := progress.Start(progress.PhasePush, imageDestination, 0)
+	err = image.Push(ctx, containerImage.Image, imageDestination, imagePushTimeout, reporter)
+	reporter.Stop()
+	if err != nil {
 		return err
 	}
 
-	log.Println("Successfully uploaded to the container registry.")
+	if err := containerImage.Verify(); err != nil {
+		return fmt.Errorf("pushed image '%s' doesn't match its checksum, not tagging it: %w", imageDestination, err)
+	}
+
+	log.Printf("Tagging container image '%s'...", imageDestination)
+
+	if err := image.Tag(ctx, containerImage.Image, imageDestination, imagePushTimeout); err != nil {
+		return err
+	}
+
+	if vmManifests == nil {
+		return nil
+	}
+
+	log.Printf("Attaching manifests to '%s'...", imageDestination)
+
+	return image.PushManifests(ctx, vmManifests, imageDestination, imagePushTimeout)
+}
+
+// setup creates the client and sets the namespace of the export source. Without
+// --export-source-namespace, it falls back to POD_NAMESPACE, which is the namespace
+// of the uploader, and then to the namespace of the kubeconfig context.
+func setup(clientConfig clientcmd.ClientConfig, opts *RunOptions) error {
+	client, err := kubecli.GetKubevirtClientFromClientConfig(clientConfig)
+	if err != nil {
+		return err
+	}
+	opts.client = client
+
+	if opts.exportSourceName == "" && opts.selector == "" {
+		return fmt.Errorf("export-source-name or selector must be set")
+	}
+
+	if opts.allNamespaces && opts.selector == "" {
+		return fmt.Errorf("all-namespaces can be used only with selector")
+	}
+
+	if opts.exportSourceNamespace == "" {
+		opts.exportSourceNamespace = os.Getenv("POD_NAMESPACE")
+	}
+
+	if opts.exportSourceNamespace == "" {
+		if namespace, _, err := clientConfig.Namespace(); err == nil {
+			opts.exportSourceNamespace = namespace
+		}
+	}
 	return nil
 }
 
+// setupProgress sets the interval of the progress reports, and the file the JSON stream
+// of the reports is written to, "-" for stdout. The file is returned to be closed once
+// the run is done, or nil when there's none.
+func setupProgress(interval int, jsonPath string) (*os.File, error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("invalid progress-interval: %d, must be at least 0", interval)
+	}
+	progress.SetInterval(time.Second * time.Duration(interval))
+
+	switch jsonPath {
+	case "":
+	case "-":
+		progress.SetJSONOutput(os.Stdout)
+	default:
+		file, err := os.Create(jsonPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create progress-json file: %w", err)
+		}
+		progress.SetJSONOutput(file)
+		return file, nil
+	}
+	return nil, nil
+}
+
+// closeProgress syncs and closes the file of the JSON stream, so the final reports are
+// on disk when the uploader exits.
+func closeProgress(file *os.File) {
+	if file == nil {
+		return
+	}
+
+	if err := file.Sync(); err != nil {
+		log.Printf("Failed to sync progress-json file: %v", err)
+	}
+
+	if err := file.Close(); err != nil {
+		log.Printf("Failed to close progress-json file: %v", err)
+	}
+}
+
 func main() {
-	var opts RunOptions
+	// Log lines and errors are logged with the export tokens masked.
+	log.SetOutput(redact.NewWriter(os.Stderr))
+
+	opts := RunOptions{scratchDir: scratchDir}
+	var clientConfig clientcmd.ClientConfig
 	var command = &cobra.Command{
 		Use:   "kubevirt-disk-uploader",
 		Short: "Extracts disk and uploads it to a container registry",
 		Run: func(cmd *cobra.Command, args []string) {
-			client, err := kubecli.GetKubevirtClient()
+			if err := setup(clientConfig, &opts); err != nil {
+				log.Panicln(err)
+			}
+
+			progressFile, err := setupProgress(opts.progressInterval, opts.progressJSON)
 			if err != nil {
 				log.Panicln(err)
 			}
-			opts.client = client
+			defer closeProgress(progressFile)
 
-			namespace := os.Getenv("POD_NAMESPACE")
-			if namespace != "" {
-				opts.exportSourceNamespace = namespace
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			runFunc := run
+			if opts.selector != "" {
+				runFunc = runBatch
 			}
 
-			if err := run(opts); err != nil {
-				log.Panicln(err)
+			if err := runFunc(ctx, opts); err != nil {
+				// The panic message is printed as it is, so mask the tokens here as well.
+				log.Panicln(redact.String(err.Error()))
 			}
 		},
 	}
 
-	command.Flags().StringVar(&opts.exportSourceKind, "export-source-kind", "", "specify the export source kind (vm, vmsnapshot, pvc)")
-	command.Flags().StringVar(&opts.exportSourceNamespace, "export-source-namespace", "", "namespace of the export source")
-	command.Flags().StringVar(&opts.exportSourceName, "export-source-name", "", "name of the export source")
-	command.Flags().StringVar(&opts.volumeName, "volumename", "", "name of the volume (if source kind is 'pvc', then volume name is equal to source name)")
-	command.Flags().StringVar(&opts.imageDestination, "imagedestination", "", "destination of the image in container registry")
+	clientConfig = kubecli.DefaultClientConfig(command.PersistentFlags())
+	command.PersistentFlags().StringVar(&opts.exportSourceKind, "export-source-kind", "", "specify the export source kind (vm, vmsnapshot, pvc, datavolume, datasource, volumesnapshot)")
+	command.PersistentFlags().StringVar(&opts.exportSourceNamespace, "export-source-namespace", "", "namespace of the export source (defaults to the namespace of the uploader)")
+	command.PersistentFlags().StringVar(&opts.exportSourceName, "export-source-name", "", "name of the export source")
+	command.PersistentFlags().StringVar(&opts.volumeName, "volumename", "", "name of the volume, see list-volumes (if source kind is 'pvc', 'datavolume', 'datasource' or 'volumesnapshot', then volume name is set automatically)")
+	command.PersistentFlags().BoolVar(&opts.allVolumes, "all-volumes", false, "export and upload every volume of the export source")
+	command.PersistentFlags().StringVar(&opts.link, "link", vmexport.LinkAuto, "export link to download from (internal, external, auto: internal when running inside the cluster)")
+	command.PersistentFlags().BoolVar(&opts.portForward, "port-forward", false, "download through a port-forward to the export server, for clusters without Ingress or Route")
+	command.PersistentFlags().BoolVar(&opts.snapshotFirst, "snapshot-first", false, "take a VirtualMachineSnapshot of the VM and export it instead, so the VM can keep running")
+	command.PersistentFlags().BoolVar(&opts.stopVM, "stop-vm", false, "stop the VM for the export and restore its run state afterwards")
+	command.PersistentFlags().StringVar(&opts.owner, "owner", "", "owner of the created objects as kind/name, e.g. job/example (defaults to the pod of the uploader, 'none' to disable)")
+	command.Flags().StringVar(&opts.imageDestination, "imagedestination", "", "destination of the image in container registry ({namespace}, {vm} and {volume} are replaced by the source namespace, source name and volume name)")
 	command.Flags().IntVar(&opts.pushTimeout, "pushtimeout", 60, "push timeout of container disk to registry")
-	command.MarkFlagRequired("export-source-kind")
-	command.MarkFlagRequired("export-source-name")
-	command.MarkFlagRequired("volumename")
+	command.Flags().BoolVar(&opts.keepExport, "keep-export", false, "keep the VirtualMachineExport and Secret after the run (for debugging)")
+	command.Flags().IntVar(&opts.exportTTL, "export-ttl", 720, "time in minutes after which the VirtualMachineExport is deleted even if the run didn't clean it up")
+	command.Flags().BoolVar(&opts.manifests, "manifests", false, "attach the exported manifests (e.g. VirtualMachine) to the image as OCI referrer")
+	command.Flags().BoolVar(&opts.keepSnapshot, "keep-snapshot", false, "keep the VirtualMachineSnapshot taken with --snapshot-first after the run")
+	command.Flags().StringVar(&opts.onExisting, "on-existing", onExistingFail, "policy when a VirtualMachineExport of the source is left behind by a previous run (reuse, replace, fail)")
+	command.Flags().IntVar(&opts.lockTimeout, "lock-timeout", 0, "time in minutes to wait while another run exports the same source (0 fails right away)")
+	command.Flags().BoolVar(&opts.skipPreflight, "skip-preflight", false, "skip the preflight checks at the start of the run")
+	command.Flags().StringVar(&opts.selector, "selector", "", "export every source of the kind matching the label selector (e.g. app=golden), instead of export-source-name")
+	command.Flags().BoolVar(&opts.allNamespaces, "all-namespaces", false, "match the selector in all namespaces")
+	command.Flags().IntVar(&opts.concurrency, "concurrency", 1, "number of sources matching the selector exported at a time")
+	command.Flags().StringVar(&opts.caBundle, "ca-bundle", "", "path of a PEM bundle of additional CAs trusted for the export server, e.g. of a proxy intercepting TLS")
+	command.Flags().StringVar(&opts.downloader, "downloader", downloaderNbdkit, "backend downloading the disks (nbdkit, native: without nbdkit, converted with qemu-img)")
+	command.Flags().BoolVar(&opts.requireSourceDigest, "require-source-digest", false, "fail unless every image gets the digest of its raw disk in the source-raw-digest annotation (native downloader only)")
+	command.Flags().StringVar(&opts.downloadFormat, "download-format", downloadFormatRaw, "format of the disks downloaded by the native downloader (raw, gzip: compressed by the export server)")
+	command.Flags().IntVar(&opts.downloadRetries, "download-retries", 5, "number of times the native downloader resumes an interrupted raw download")
+	command.Flags().IntVar(&opts.downloadWorkers, "download-workers", 1, "number of concurrent Range requests downloading segments of each disk with the native downloader")
+	command.Flags().StringVar(&opts.diskFormat, "disk-format", disk.FormatQcow2, "format of the disk in the image (qcow2, raw)")
+	command.Flags().StringVar(&opts.compression, "compression", disk.CompressionNone, "compression of the qcow2 disk (none, zlib, zstd)")
+	command.Flags().StringVar(&opts.clusterSize, "cluster-size", "", "cluster size of the qcow2 disk, e.g. 64k (defaults to the one of qemu-img)")
+	command.Flags().StringVar(&opts.sparseSize, "sparse-size", "4k", "size of the zeroed ranges of the disk turned into holes, e.g. 4k (0 disables sparse detection)")
+	command.Flags().IntVar(&opts.progressInterval, "progress-interval", 30, "interval in seconds of the progress reports of the download, conversion and push (0 reports only when each is done)")
+	command.Flags().StringVar(&opts.progressJSON, "progress-json", "", "file the progress reports are also written to as JSON lines ('-' for stdout)")
+	command.Flags().IntVar(&opts.segmentSize, "segment-size", 64, "size in MiB of the segments downloaded with --download-workers")
+	command.MarkPersistentFlagRequired("export-source-kind")
 	command.MarkFlagRequired("imagedestination")
+	command.MarkFlagsMutuallyExclusive("export-source-name", "selector")
+	command.MarkFlagsMutuallyExclusive("volumename", "all-volumes")
+	command.MarkFlagsMutuallyExclusive("snapshot-first", "stop-vm")
+
+	command.AddCommand(newPreflightCommand(clientConfig, &opts))
+	command.AddCommand(newListVolumesCommand(clientConfig, &opts))
 
 	if err := command.Execute(); err != nil {
 		log.Println(err)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/preflight"
+
+	cobra "github.com/spf13/cobra"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+func newPreflightCommand(clientConfig clientcmd.ClientConfig, opts *RunOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "preflight",
+		Short: "Checks that the export can run, without creating any objects",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := setup(clientConfig, opts); err != nil {
+				return err
+			}
+
+			checks := preflight.Run(opts.client, getPreflightOptions(*opts))
+			preflight.PrintReport(os.Stdout, checks)
+
+			if !preflight.Passed(checks) {
+				cmd.SilenceUsage = true
+				return fmt.Errorf("preflight checks failed")
+			}
+			return nil
+		},
+	}
+}
+
+func getPreflightOptions(opts RunOptions) preflight.Options {
+	return preflight.Options{
+		ExportSourceKind:      opts.exportSourceKind,
+		ExportSourceNamespace: opts.exportSourceNamespace,
+		ExportSourceName:      opts.exportSourceName,
+		VolumeName:            opts.volumeName,
+		AllVolumes:            opts.allVolumes,
+		ScratchPath:           opts.scratchDir,
+		SnapshotFirst:         opts.snapshotFirst,
+		StopVM:                opts.stopVM,
+		PortForward:           opts.portForward,
+		Owner:                 opts.owner,
+	}
+}
@@ -0,0 +1,41 @@
+package cdi
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecli "kubevirt.io/client-go/kubecli"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+func GetDataVolumeClaimName(client kubecli.KubevirtClient, namespace, name string) (string, error) {
+	dataVolume, err := client.CdiClient().CdiV1beta1().DataVolumes(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	// CDI names the PVC after the DataVolume unless the status tells otherwise.
+	if dataVolume.Status.ClaimName != "" {
+		return dataVolume.Status.ClaimName, nil
+	}
+	return dataVolume.Name, nil
+}
+
+func GetDataSourceSource(client kubecli.KubevirtClient, namespace, name string) (*cdiv1beta1.DataSourceSource, error) {
+	dataSource, err := client.CdiClient().CdiV1beta1().DataSources(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	source := dataSource.Status.Source
+	if source.PVC == nil && source.Snapshot == nil {
+		source = dataSource.Spec.Source
+	}
+
+	if source.PVC == nil && source.Snapshot == nil {
+		return nil, fmt.Errorf("no source found in DataSource '%s/%s'", namespace, name)
+	}
+	return &source, nil
+}
@@ -1,41 +1,96 @@
 package certificate
 
 import (
+	"bytes"
 	"context"
+	"crypto/x509"
 	"fmt"
 	"os"
 
+	"github.com/codingben/kubevirt-disk-uploader/pkg/vmexport"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubecli "kubevirt.io/client-go/kubecli"
 )
 
-func GetCertificateFromVirtualMachineExport(client kubecli.KubevirtClient, namespace, name string) (string, error) {
+// GetCertificateFromVirtualMachineExport returns the certificate of the export link. The
+// external link may have no certificate when it's signed by a publicly trusted CA.
+func GetCertificateFromVirtualMachineExport(client kubecli.KubevirtClient, namespace, name, link string) (string, error) {
 	vmExport, err := client.VirtualMachineExport(namespace).Get(context.Background(), name, metav1.GetOptions{})
 	if err != nil {
 		return "", err
 	}
 
-	if vmExport.Status.Links == nil && vmExport.Status.Links.Internal == nil {
-		return "", fmt.Errorf("no links found in VirtualMachineExport status")
+	exportLink, err := vmexport.GetExportLink(vmExport, link)
+	if err != nil {
+		return "", err
 	}
 
-	content := vmExport.Status.Links.Internal.Cert
-	if content == "" {
+	content := exportLink.Cert
+	if content == "" && link != vmexport.LinkExternal {
 		return "", fmt.Errorf("no certificate found in VirtualMachineExport status")
 	}
 	return content, nil
 }
 
-func CreateCertificateFile(path, data string) error {
-	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+// ReadCABundle reads the PEM bundle of additional CAs, e.g. of a proxy intercepting TLS.
+func ReadCABundle(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	caBundle, err := os.ReadFile(path)
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		return nil, fmt.Errorf("failed to read CA bundle: %w", err)
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(data)
+	if !x509.NewCertPool().AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("no certificate found in CA bundle '%s'", path)
+	}
+	return caBundle, nil
+}
+
+// GetCertificateBundle merges the certificate of the export link and the CA bundle.
+func GetCertificateBundle(certificateData string, caBundle []byte) []byte {
+	var bundle bytes.Buffer
+	for _, data := range [][]byte{[]byte(certificateData), caBundle} {
+		if len(data) == 0 {
+			continue
+		}
+		bundle.Write(data)
+		if !bytes.HasSuffix(data, []byte("\n")) {
+			bundle.WriteString("\n")
+		}
+	}
+	return bundle.Bytes()
+}
+
+// GetCertPool returns the pool of the certificates trusted for the export server, or nil
+// to trust the system roots when the bundle is empty.
+func GetCertPool(certificateBundle []byte) (*x509.CertPool, error) {
+	if len(certificateBundle) == 0 {
+		return nil, nil
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(certificateBundle) {
+		return nil, fmt.Errorf("failed to parse VirtualMachineExport certificate")
+	}
+	return certPool, nil
+}
+
+// CreateCertificateFile writes the certificate bundle to a temporary file in the directory,
+// readable by the owner only, for tools that can't use a CertPool. The caller removes it.
+func CreateCertificateFile(dir string, certificateBundle []byte) (string, error) {
+	file, err := os.CreateTemp(dir, "tls-*.crt")
 	if err != nil {
-		return fmt.Errorf("failed to write content to file: %w", err)
+		return "", fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(certificateBundle); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write content to file: %w", err)
 	}
-	return nil
+	return file.Name(), nil
 }
@@ -1,29 +1,218 @@
 package disk
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/redact"
 )
 
-func DownloadDiskImageFromURL(rawDiskUrl, headerKey, headerValue, certificatePath, diskPath string) error {
-	cmd := exec.Command(
-		"nbdkit",
+const (
+	FormatQcow2 string = "qcow2"
+	FormatRaw   string = "raw"
+
+	CompressionNone string = "none"
+	CompressionZlib string = "zlib"
+	CompressionZstd string = "zstd"
+)
+
+// ConvertOptions are the options of qemu-img convert, writing the disk of the image.
+type ConvertOptions struct {
+	Format string
+	// Compression of the qcow2 clusters, which are decompressed when they're read.
+	Compression string
+	// ClusterSize of qcow2, e.g. 64k. The default of qemu-img is used when empty.
+	ClusterSize string
+	// SparseSize is the size of the zeroed ranges turned into holes, 0 disables it.
+	SparseSize string
+}
+
+// The sizes are passed to the shell of nbdkit, so only sizes like 64k are allowed.
+var sizeRegexp = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+
+func (o ConvertOptions) Validate() error {
+	if o.Format != FormatQcow2 && o.Format != FormatRaw {
+		return fmt.Errorf("invalid disk-format: %s, must be one of qcow2, raw", o.Format)
+	}
+
+	if o.Compression != CompressionNone && o.Compression != CompressionZlib && o.Compression != CompressionZstd {
+		return fmt.Errorf("invalid compression: %s, must be one of none, zlib, zstd", o.Compression)
+	}
+
+	if o.Format != FormatQcow2 && (o.Compression != CompressionNone || o.ClusterSize != "") {
+		return fmt.Errorf("compression and cluster-size can be used only with disk-format qcow2")
+	}
+
+	if o.ClusterSize != "" && !sizeRegexp.MatchString(o.ClusterSize) {
+		return fmt.Errorf("invalid cluster-size: %s, must be a size like 64k", o.ClusterSize)
+	}
+
+	if !sizeRegexp.MatchString(o.SparseSize) {
+		return fmt.Errorf("invalid sparse-size: %s, must be a size like 4k", o.SparseSize)
+	}
+	return nil
+}
+
+// getArgs returns the arguments of qemu-img convert for the output disk. It's never
+// preallocated, so it takes only the space of its data.
+func (o ConvertOptions) getArgs() []string {
+	createOptions := []string{"preallocation=off"}
+	args := []string{"-O", o.Format, "-S", o.SparseSize}
+
+	if o.ClusterSize != "" {
+		createOptions = append(createOptions, fmt.Sprintf("cluster_size=%s", o.ClusterSize))
+	}
+
+	if o.Compression != CompressionNone {
+		createOptions = append(createOptions, fmt.Sprintf("compression_type=%s", o.Compression))
+		args = append(args, "-c")
+	}
+	return append(args, "-o", strings.Join(createOptions, ","))
+}
+
+// headerValueEnv passes the header value to the header script of nbdkit, so it doesn't show
+// up in the command line of the processes, which is readable by everyone in /proc.
+const headerValueEnv string = "KUBEVIRT_DISK_UPLOADER_HEADER_VALUE"
+
+// DownloadDiskImageFromURL downloads the raw disk and converts it with the options. The optional
+// resolve entry (HOST:PORT:ADDRESS) makes curl connect to another address, e.g. a port-forward.
+func DownloadDiskImageFromURL(ctx context.Context, rawDiskUrl, headerKey, headerValue, certificatePath, resolve, diskPath string, options ConvertOptions, reporter *progress.Reporter) error {
+	args := []string{
 		"-r",
 		"curl",
 		rawDiskUrl,
-		fmt.Sprintf("header=%s: %s", headerKey, headerValue),
-		fmt.Sprintf("cainfo=%s", certificatePath),
-		"--run",
-		fmt.Sprintf("qemu-img convert \"$uri\" -O qcow2 %s", diskPath),
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+		fmt.Sprintf("header-script=printf '%%s: %%s\\n' '%s' \"$%s\"", headerKey, headerValueEnv),
+	}
+
+	// Without a certificate, the system trust store is used.
+	if certificatePath != "" {
+		args = append(args, fmt.Sprintf("cainfo=%s", certificatePath))
+	}
+
+	if resolve != "" {
+		args = append(args, fmt.Sprintf("resolve=%s", resolve))
+	}
+
+	args = append(args, "--run", fmt.Sprintf("qemu-img convert -p \"$uri\" %s %s", strings.Join(options.getArgs(), " "), diskPath))
 
-	if err := cmd.Run(); err != nil {
+	// The output is passed on to stderr, as stdout may carry the JSON progress stream.
+	stderr := redact.NewWriter(os.Stderr)
+	defer stderr.Flush()
+
+	// The download and the conversion are a single step, whose progress is only known
+	// as percentage from qemu-img.
+	cmd := exec.CommandContext(ctx, "nbdkit", args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", headerValueEnv, headerValue))
+	progressWriter := newQemuProgressWriter(reporter, stderr)
+	cmd.Stdout = progressWriter
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	progressWriter.Flush()
+	if err != nil {
 		return err
 	}
+	return checkDiskImage(diskPath)
+}
+
+// ConvertDiskImage converts the raw disk downloaded by the native downloader with the options.
+func ConvertDiskImage(ctx context.Context, rawDiskPath, diskPath string, options ConvertOptions, reporter *progress.Reporter) error {
+	if fileInfo, err := os.Stat(rawDiskPath); err == nil {
+		reporter.SetTotal(fileInfo.Size())
+	}
+
+	args := append([]string{"convert", "-p", "-f", "raw"}, options.getArgs()...)
+	cmd := exec.CommandContext(ctx, "qemu-img", append(args, rawDiskPath, diskPath)...)
+	progressWriter := newQemuProgressWriter(reporter, os.Stderr)
+	cmd.Stdout = progressWriter
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	progressWriter.Flush()
+	if err != nil {
+		return fmt.Errorf("failed to convert disk image: %w", err)
+	}
+	return checkDiskImage(diskPath)
+}
+
+// GetDigest returns the SHA-256 digest of the disk, e.g. "sha256:<hex>".
+func GetDigest(diskPath string) (string, error) {
+	file, err := os.Open(diskPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to compute digest of disk image: %w", err)
+	}
+	return fmt.Sprintf("sha256:%x", hash.Sum(nil)), nil
+}
+
+// qemuProgressWriter sets the progress from the output of qemu-img convert -p, e.g.
+// "    (12.34/100%)\r". The output is split into lines at \r and \n, and the lines
+// without progress are passed on to the output.
+type qemuProgressWriter struct {
+	reporter *progress.Reporter
+	output   io.Writer
+	buffer   bytes.Buffer
+}
+
+var qemuProgressRegexp = regexp.MustCompile(`\((\d+\.\d+)/100%\)`)
+
+func newQemuProgressWriter(reporter *progress.Reporter, output io.Writer) *qemuProgressWriter {
+	return &qemuProgressWriter{reporter: reporter, output: output}
+}
+
+func (w *qemuProgressWriter) Write(p []byte) (int, error) {
+	w.buffer.Write(p)
+	for {
+		index := bytes.IndexAny(w.buffer.Bytes(), "\r\n")
+		if index == -1 {
+			return len(p), nil
+		}
+
+		line := w.buffer.Next(index + 1)
+		if err := w.writeLine(line[:index]); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// Flush writes the last line, which isn't terminated.
+func (w *qemuProgressWriter) Flush() error {
+	line := bytes.Clone(w.buffer.Bytes())
+	w.buffer.Reset()
+	return w.writeLine(line)
+}
+
+func (w *qemuProgressWriter) writeLine(line []byte) error {
+	if matches := qemuProgressRegexp.FindSubmatch(line); matches != nil {
+		if percent, err := strconv.ParseFloat(string(matches[1]), 64); err == nil {
+			w.reporter.SetPercent(percent)
+		}
+		return nil
+	}
+
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w.output, "%s\n", line)
+	return err
+}
 
+func checkDiskImage(diskPath string) error {
 	if fileInfo, err := os.Stat(diskPath); err != nil || fileInfo.Size() == 0 {
 		return fmt.Errorf("disk image file does not exist or is empty")
 	}
@@ -0,0 +1,140 @@
+package disk
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+)
+
+// HTTPStatusError is returned when the export server responds with an unexpected status.
+type HTTPStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("export server responded with %s", e.Status)
+}
+
+// TLSError is returned when the certificate of the export server isn't trusted, or the
+// TLS handshake fails.
+type TLSError struct {
+	Err error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("TLS connection to export server failed: %v", e.Err)
+}
+
+func (e *TLSError) Unwrap() error {
+	return e.Err
+}
+
+// ShortReadError is returned when the connection ends before the whole disk is received.
+// Expected is -1 when the size of the disk isn't known.
+type ShortReadError struct {
+	Expected int64
+	Received int64
+	Err      error
+}
+
+func (e *ShortReadError) Error() string {
+	if e.Expected < 0 {
+		return fmt.Sprintf("disk image download ended early after %d bytes: %v", e.Received, e.Err)
+	}
+	return fmt.Sprintf("disk image download ended early after %d of %d bytes: %v", e.Received, e.Expected, e.Err)
+}
+
+func (e *ShortReadError) Unwrap() error {
+	return e.Err
+}
+
+// DownloadRawDiskImage streams the raw disk from the export server to rawDiskPath, without
+// nbdkit. The gzip URL of the export is decompressed on the fly.
+func DownloadRawDiskImage(ctx context.Context, client *http.Client, diskUrl string, gzipped bool, headerKey, headerValue, rawDiskPath string, reporter *progress.Reporter) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, diskUrl, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set(headerKey, headerValue)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return wrapTLSError(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return &HTTPStatusError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	file, err := os.OpenFile(rawDiskPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	// The progress is of the downloaded bytes, which are compressed with gzip.
+	reporter.SetTotal(max(response.ContentLength, 0))
+	var body io.Reader = &progressReader{reader: response.Body, reporter: reporter}
+
+	// The size is known for the raw disk only, gzip detects truncation on its own.
+	expected := response.ContentLength
+	if gzipped {
+		gzipReader, err := gzip.NewReader(body)
+		if err != nil {
+			return &ShortReadError{Expected: -1, Err: err}
+		}
+		defer gzipReader.Close()
+		body, expected = gzipReader, -1
+	}
+
+	received, err := io.Copy(file, body)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return &ShortReadError{Expected: expected, Received: received, Err: err}
+	}
+	if err != nil {
+		return wrapTLSError(err)
+	}
+
+	if expected >= 0 && received != expected {
+		return &ShortReadError{Expected: expected, Received: received, Err: io.ErrUnexpectedEOF}
+	}
+	return file.Close()
+}
+
+// progressReader adds the bytes read to the progress.
+type progressReader struct {
+	reader   io.Reader
+	reporter *progress.Reporter
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.reporter.Add(int64(n))
+	return n, err
+}
+
+func wrapTLSError(err error) error {
+	var certificateVerificationError *tls.CertificateVerificationError
+	var unknownAuthorityError x509.UnknownAuthorityError
+	var hostnameError x509.HostnameError
+	var recordHeaderError tls.RecordHeaderError
+	var alertError tls.AlertError
+	if errors.As(err, &certificateVerificationError) ||
+		errors.As(err, &unknownAuthorityError) ||
+		errors.As(err, &hostnameError) ||
+		errors.As(err, &recordHeaderError) ||
+		errors.As(err, &alertError) {
+		return &TLSError{Err: err}
+	}
+	return err
+}
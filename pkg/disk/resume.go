@@ -0,0 +1,315 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+)
+
+const (
+	// The offset is committed to the state file every commitInterval bytes.
+	commitInterval int64 = 64 * 1024 * 1024
+	// The bytes before the offset are downloaded again and compared with the file, to
+	// verify the file still belongs to the same disk.
+	verifyLength     int64 = 1024 * 1024
+	copyBufferSize         = 1024 * 1024
+	retryInterval          = 2 * time.Second
+	maxRetryInterval       = time.Minute
+)
+
+var (
+	// errRestart makes the download start over, when the disk doesn't match the state file.
+	errRestart = errors.New("disk changed since the download started")
+	// errRangeNotSupported is returned when the export server ignores the Range header.
+	errRangeNotSupported = errors.New("export server doesn't support Range requests")
+)
+
+// downloadState is stored next to the raw disk, so the download continues from the last
+// committed offset, after a connection drop or a restart of the uploader.
+type downloadState struct {
+	// Key identifies the disk, e.g. the export source and the volume name, as the URL
+	// changes with every VirtualMachineExport.
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+// GetStatePath returns the path of the state file of the raw disk.
+func GetStatePath(rawDiskPath string) string {
+	return fmt.Sprintf("%s.state", rawDiskPath)
+}
+
+// ResumeRawDiskImage downloads the raw disk from the export server with Range requests,
+// continuing from the offset in the state file of rawDiskPath if it belongs to the same
+// disk. Interrupted requests are retried up to retries times. The raw disk and its state
+// file are kept after the download, and removed by the caller once they're used.
+func ResumeRawDiskImage(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue, rawDiskPath, key string, retries int, reporter *progress.Reporter) error {
+	statePath := GetStatePath(rawDiskPath)
+	state := loadState(statePath, key)
+	reporter.SetTotal(state.Size)
+	reporter.Resume(state.Offset)
+
+	file, err := os.OpenFile(rawDiskPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	if state.Offset > 0 {
+		log.Printf("Resuming download at %d of %d bytes...", state.Offset, state.Size)
+	}
+
+	for attempt := 0; ; attempt++ {
+		if state.Offset == 0 {
+			if err := file.Truncate(0); err != nil {
+				return err
+			}
+		}
+
+		err = fetchRange(ctx, client, rawDiskUrl, headerKey, headerValue, file, statePath, &state, reporter)
+		if err == nil {
+			break
+		}
+
+		// Restarts count as retries, e.g. when the connection keeps dropping and the
+		// server ignores the Range header, except the restart of a stale state file.
+		restart := errors.Is(err, errRestart)
+		if (!restart && !isRetryable(err)) || ctx.Err() != nil {
+			return err
+		}
+
+		if attempt >= retries && (!restart || attempt > 0) {
+			return err
+		}
+
+		if restart {
+			log.Printf("Restarting download: %v", err)
+			state = downloadState{Key: key}
+		}
+
+		interval := getRetryInterval(attempt)
+		log.Printf("Download interrupted at %d of %d bytes, retrying in %s: %v", state.Offset, state.Size, interval, err)
+
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// fetchRange downloads the disk from the committed offset to the end, and commits the
+// offset to the state file as the download goes.
+func fetchRange(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue string, file *os.File, statePath string, state *downloadState, reporter *progress.Reporter) error {
+	verify := min(state.Offset, verifyLength)
+	rangeStart := state.Offset - verify
+
+	response, size, err := requestRange(ctx, client, rawDiskUrl, headerKey, headerValue, rangeStart, -1)
+	if errors.Is(err, errRangeNotSupported) {
+		return fmt.Errorf("%w: %v", errRestart, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if state.Size != 0 && state.Size != size {
+		return fmt.Errorf("%w: size changed from %d to %d bytes", errRestart, state.Size, size)
+	}
+	state.Size = size
+	reporter.SetTotal(size)
+
+	if verify > 0 {
+		if err := verifyRange(response.Body, file, rangeStart, verify); err != nil {
+			return err
+		}
+	}
+
+	offset := state.Offset
+	reporter.Set(offset)
+	buffer := make([]byte, copyBufferSize)
+	for offset < size {
+		n, readErr := response.Body.Read(buffer)
+		if n > 0 {
+			if _, err := file.WriteAt(buffer[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			reporter.Set(offset)
+
+			if offset-state.Offset >= commitInterval {
+				if err := commitState(file, statePath, state, offset); err != nil {
+					return err
+				}
+			}
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			commitState(file, statePath, state, offset)
+			return &ShortReadError{Expected: size, Received: offset, Err: readErr}
+		}
+	}
+
+	if err := commitState(file, statePath, state, offset); err != nil {
+		return err
+	}
+
+	if offset != size {
+		return &ShortReadError{Expected: size, Received: offset, Err: io.ErrUnexpectedEOF}
+	}
+	return nil
+}
+
+// requestRange requests the bytes from start to end of the disk, or to the end of the
+// disk when end is negative, and returns the size of the disk. A server ignoring the
+// Range header is accepted only for requests of the whole disk.
+func requestRange(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue string, start, end int64) (*http.Response, int64, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawDiskUrl, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	request.Header.Set(headerKey, headerValue)
+	if end < 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", start))
+	} else {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, 0, wrapTLSError(err)
+	}
+
+	size := response.ContentLength
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		var rangeStart, rangeEnd int64
+		if _, err := fmt.Sscanf(response.Header.Get("Content-Range"), "bytes %d-%d/%d", &rangeStart, &rangeEnd, &size); err != nil || rangeStart != start {
+			response.Body.Close()
+			return nil, 0, fmt.Errorf("invalid Content-Range from export server: %s", response.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		if start > 0 || end >= 0 {
+			response.Body.Close()
+			return nil, 0, errRangeNotSupported
+		}
+	default:
+		response.Body.Close()
+		return nil, 0, &HTTPStatusError{StatusCode: response.StatusCode, Status: response.Status}
+	}
+
+	if size < 0 {
+		response.Body.Close()
+		return nil, 0, fmt.Errorf("export server didn't report the size of the disk")
+	}
+	return response, size, nil
+}
+
+// GetDiskSize returns the size of the disk on the export server, with a request of its
+// first byte.
+func GetDiskSize(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue string) (int64, error) {
+	response, size, err := requestRange(ctx, client, rawDiskUrl, headerKey, headerValue, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	response.Body.Close()
+	return size, nil
+}
+
+// verifyRange compares the bytes before the committed offset with the file.
+func verifyRange(body io.Reader, file *os.File, start, length int64) error {
+	downloaded := make([]byte, length)
+	if _, err := io.ReadFull(body, downloaded); err != nil {
+		return &ShortReadError{Expected: length, Err: err}
+	}
+
+	existing := make([]byte, length)
+	if _, err := file.ReadAt(existing, start); err != nil {
+		return fmt.Errorf("%w: %v", errRestart, err)
+	}
+
+	if !bytes.Equal(downloaded, existing) {
+		return fmt.Errorf("%w: downloaded bytes don't match the file", errRestart)
+	}
+	return nil
+}
+
+// commitState syncs the file before the offset is written to the state file, so the
+// state never points past the data on disk.
+func commitState(file *os.File, statePath string, state *downloadState, offset int64) error {
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	state.Offset = offset
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := fmt.Sprintf("%s.tmp", statePath)
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statePath)
+}
+
+// loadState loads the state file, or starts over if it's missing or of another disk.
+func loadState(statePath, key string) downloadState {
+	state := downloadState{Key: key}
+
+	data, err := os.ReadFile(statePath)
+	if err != nil {
+		return state
+	}
+
+	var saved downloadState
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Key != key || saved.Offset < 0 || saved.Offset > saved.Size {
+		return state
+	}
+	return saved
+}
+
+func getRetryInterval(attempt int) time.Duration {
+	return min(retryInterval<<attempt, maxRetryInterval)
+}
+
+func sleep(ctx context.Context, interval time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(interval):
+		return nil
+	}
+}
+
+// isRetryable reports whether the download can continue after the error, unlike e.g.
+// TLS failures or a missing token.
+func isRetryable(err error) bool {
+	if errors.Is(err, errRangeNotSupported) {
+		return false
+	}
+
+	var tlsError *TLSError
+	if errors.As(err, &tlsError) {
+		return false
+	}
+
+	var statusError *HTTPStatusError
+	if errors.As(err, &statusError) {
+		return statusError.StatusCode >= http.StatusInternalServerError || statusError.StatusCode == http.StatusTooManyRequests
+	}
+
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
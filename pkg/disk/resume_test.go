@@ -0,0 +1,343 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+)
+
+const (
+	testKey         string = "vm/default/example/disk"
+	testHeaderKey   string = "x-kubevirt-export-token"
+	testHeaderValue string = "token"
+)
+
+// exportServer serves the disk like the export server, with Range support unless
+// ignoreRange is set. The requests are recorded, and handle can fail them.
+type exportServer struct {
+	*httptest.Server
+	data        []byte
+	ignoreRange bool
+	handle      func(w http.ResponseWriter, request *http.Request, count int) bool
+
+	mutex    sync.Mutex
+	requests []string
+}
+
+func newExportServer(t *testing.T, data []byte) *exportServer {
+	server := &exportServer{data: data}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func (s *exportServer) serve(w http.ResponseWriter, request *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, request.Header.Get("Range"))
+	count := len(s.requests)
+	s.mutex.Unlock()
+
+	if request.Header.Get(testHeaderKey) != testHeaderValue {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if s.handle != nil && s.handle(w, request, count) {
+		return
+	}
+
+	if s.ignoreRange {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.data)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(s.data)
+		return
+	}
+	http.ServeContent(w, request, "disk.img", time.Time{}, bytes.NewReader(s.data))
+}
+
+func (s *exportServer) getRequests() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// truncate sends the headers of the whole disk, but only length bytes of the body, and
+// drops the connection.
+func truncate(w http.ResponseWriter, data []byte, length int) {
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data[:length])
+	w.(http.Flusher).Flush()
+	panic(http.ErrAbortHandler)
+}
+
+// newTestData returns a disk of size bytes, with random data and a range of zeros.
+func newTestData(size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(1)).Read(data)
+	clear(data[size/2 : size/2+size/4])
+	return data
+}
+
+func newTestReporter(t *testing.T) *progress.Reporter {
+	progress.SetInterval(0)
+	reporter := progress.Start(progress.PhaseDownload, t.Name(), 0)
+	t.Cleanup(reporter.Stop)
+	return reporter
+}
+
+func writeTestState(t *testing.T, rawDiskPath string, state downloadState) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(GetStatePath(rawDiskPath), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestState(t *testing.T, rawDiskPath string) downloadState {
+	data, err := os.ReadFile(GetStatePath(rawDiskPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state downloadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		t.Fatal(err)
+	}
+	return state
+}
+
+func checkTestDisk(t *testing.T, rawDiskPath string, data []byte) {
+	disk, err := os.ReadFile(rawDiskPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(disk, data) {
+		t.Fatalf("downloaded disk of %d bytes doesn't match the disk of %d bytes", len(disk), len(data))
+	}
+}
+
+func TestResumeRawDiskImage(t *testing.T) {
+	data := newTestData(3 * 1024 * 1024)
+	server := newExportServer(t, data)
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	if state := readTestState(t, rawDiskPath); state.Offset != int64(len(data)) || state.Size != int64(len(data)) {
+		t.Fatalf("state is at %d of %d bytes, expected %d", state.Offset, state.Size, len(data))
+	}
+}
+
+func TestResumeRawDiskImageTruncatedBody(t *testing.T) {
+	data := newTestData(3 * 1024 * 1024)
+	server := newExportServer(t, data)
+	server.handle = func(w http.ResponseWriter, request *http.Request, count int) bool {
+		if count == 1 {
+			truncate(w, data, 2*1024*1024+512)
+		}
+		return false
+	}
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 1, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	// The offset of the truncated body is committed, and the bytes before it verified.
+	requests := server.getRequests()
+	if len(requests) != 2 || requests[1] != "bytes=1049088-" {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+}
+
+func TestResumeRawDiskImageTruncatedBodyWithoutRetries(t *testing.T) {
+	data := newTestData(3 * 1024 * 1024)
+	server := newExportServer(t, data)
+	server.handle = func(w http.ResponseWriter, request *http.Request, count int) bool {
+		truncate(w, data, 1024)
+		return false
+	}
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, newTestReporter(t))
+
+	var shortReadError *ShortReadError
+	if !errors.As(err, &shortReadError) {
+		t.Fatalf("expected short read error, got %v", err)
+	}
+
+	if state := readTestState(t, rawDiskPath); state.Offset != 1024 {
+		t.Fatalf("state is at %d bytes, expected 1024", state.Offset)
+	}
+}
+
+func TestResumeRawDiskImageVerifyWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		corrupt    int
+		requests   []string
+		undetected bool
+	}{
+		{
+			name:     "matching",
+			corrupt:  -1,
+			requests: []string{"bytes=1048576-"},
+		},
+		{
+			// The verify window covers the last 1MiB before the offset.
+			name:     "mismatching",
+			corrupt:  2*1024*1024 - 1,
+			requests: []string{"bytes=1048576-", "bytes=0-"},
+		},
+		{
+			name:       "mismatching before window",
+			corrupt:    1024*1024 - 1,
+			requests:   []string{"bytes=1048576-"},
+			undetected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := newTestData(3 * 1024 * 1024)
+			server := newExportServer(t, data)
+			rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+			offset := 2 * 1024 * 1024
+			existing := bytes.Clone(data[:offset])
+			if test.corrupt >= 0 {
+				existing[test.corrupt] ^= 0xff
+			}
+
+			if err := os.WriteFile(rawDiskPath, existing, 0600); err != nil {
+				t.Fatal(err)
+			}
+			writeTestState(t, rawDiskPath, downloadState{Key: testKey, Size: int64(len(data)), Offset: int64(offset)})
+
+			err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, newTestReporter(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if requests := server.getRequests(); !slices.Equal(requests, test.requests) {
+				t.Fatalf("unexpected requests %q, expected %q", requests, test.requests)
+			}
+
+			if !test.undetected {
+				checkTestDisk(t, rawDiskPath, data)
+			}
+		})
+	}
+}
+
+func TestResumeRawDiskImageOtherDisk(t *testing.T) {
+	data := newTestData(3 * 1024 * 1024)
+	server := newExportServer(t, data)
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	if err := os.WriteFile(rawDiskPath, make([]byte, 2*1024*1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestState(t, rawDiskPath, downloadState{Key: "vm/default/other/disk", Size: int64(len(data)), Offset: 2 * 1024 * 1024})
+
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	if requests := server.getRequests(); !slices.Equal(requests, []string{"bytes=0-"}) {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+}
+
+func TestResumeRawDiskImageIgnoredRange(t *testing.T) {
+	data := newTestData(3 * 1024 * 1024)
+	server := newExportServer(t, data)
+	server.ignoreRange = true
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	if err := os.WriteFile(rawDiskPath, data[:2*1024*1024], 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestState(t, rawDiskPath, downloadState{Key: testKey, Size: int64(len(data)), Offset: 2 * 1024 * 1024})
+
+	// The stale state is restarted without counting as retry, and the whole disk is
+	// downloaded again.
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	if requests := server.getRequests(); !slices.Equal(requests, []string{"bytes=1048576-", "bytes=0-"}) {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+}
+
+func TestResumeRawDiskImageIgnoredRangeRetries(t *testing.T) {
+	data := newTestData(3 * 1024 * 1024)
+	server := newExportServer(t, data)
+	server.ignoreRange = true
+	server.handle = func(w http.ResponseWriter, request *http.Request, count int) bool {
+		truncate(w, data, 2*1024*1024+512)
+		return false
+	}
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	// Every retry restarts the download, which must stop once the retries are used up.
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 1, newTestReporter(t))
+	if !errors.Is(err, errRestart) {
+		t.Fatalf("expected restart error, got %v", err)
+	}
+
+	if requests := server.getRequests(); len(requests) != 2 {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+}
+
+func TestResumeRawDiskImageStatusError(t *testing.T) {
+	data := newTestData(1024 * 1024)
+	server := newExportServer(t, data)
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	// A missing token isn't retried.
+	err := ResumeRawDiskImage(context.Background(), server.Client(), server.URL, testHeaderKey, "", rawDiskPath, testKey, 3, newTestReporter(t))
+
+	var statusError *HTTPStatusError
+	if !errors.As(err, &statusError) || statusError.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected unauthorized error, got %v", err)
+	}
+
+	if requests := server.getRequests(); len(requests) != 1 {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+}
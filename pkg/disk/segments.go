@@ -0,0 +1,223 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+)
+
+// zeros is compared with the downloaded bytes, which aren't written if they're all zeros.
+var zeros = make([]byte, copyBufferSize)
+
+// DownloadRawDiskImageSegments downloads the raw disk from the export server as segments
+// of segmentSize bytes, with workers concurrent Range requests, into a sparse file at
+// rawDiskPath. Each segment is retried up to retries times. Like ResumeRawDiskImage, the
+// offset below which every segment is downloaded is committed to the state file, so the
+// download continues from there.
+func DownloadRawDiskImageSegments(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue, rawDiskPath, key string, retries, workers int, segmentSize int64, reporter *progress.Reporter) error {
+	statePath := GetStatePath(rawDiskPath)
+	state := loadState(statePath, key)
+
+	file, err := os.OpenFile(rawDiskPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	for attempt := 0; ; attempt++ {
+		err = probeRange(ctx, client, rawDiskUrl, headerKey, headerValue, file, &state)
+		if err == nil {
+			break
+		}
+
+		if errors.Is(err, errRestart) {
+			log.Printf("Restarting download: %v", err)
+			state = downloadState{Key: key}
+			continue
+		}
+
+		if errors.Is(err, errRangeNotSupported) {
+			return fmt.Errorf("%w, use --download-workers 1", err)
+		}
+
+		if !isRetryable(err) || attempt >= retries || ctx.Err() != nil {
+			return err
+		}
+
+		interval := getRetryInterval(attempt)
+		log.Printf("Failed to request disk from export server, retrying in %s: %v", interval, err)
+
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+
+	// Everything past the committed offset is downloaded again. It's zeroed first, as the
+	// segments don't write zeros.
+	if err := file.Truncate(state.Offset); err != nil {
+		return err
+	}
+	if err := file.Truncate(state.Size); err != nil {
+		return err
+	}
+
+	first := state.Offset
+	reporter.SetTotal(state.Size)
+	reporter.Resume(first)
+	count := (state.Size - first + segmentSize - 1) / segmentSize
+
+	if first > 0 {
+		log.Printf("Resuming download at %d of %d bytes...", first, state.Size)
+	}
+	log.Printf("Downloading %d bytes in %d segments with %d workers...", state.Size-first, count, workers)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	segments := make(chan int64)
+	go func() {
+		defer close(segments)
+		for i := int64(0); i < count; i++ {
+			select {
+			case segments <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	var downloadErr error
+	done := make([]bool, count)
+	next := int64(0)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range segments {
+				start := first + i*segmentSize
+				end := min(start+segmentSize, state.Size) - 1
+
+				err := fetchSegment(ctx, client, rawDiskUrl, headerKey, headerValue, file, start, end, retries, reporter)
+
+				mutex.Lock()
+				if err == nil {
+					// The committed offset only moves past segments without gaps below them.
+					done[i] = true
+					for next < count && done[next] {
+						next++
+					}
+					err = commitState(file, statePath, &state, min(first+next*segmentSize, state.Size))
+				}
+				if err != nil && downloadErr == nil {
+					downloadErr = err
+				}
+				mutex.Unlock()
+
+				if err != nil {
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if downloadErr != nil {
+		return downloadErr
+	}
+	return file.Close()
+}
+
+// probeRange requests the first bytes of the download, to learn the size of the disk and
+// to verify the bytes before the committed offset, like fetchRange.
+func probeRange(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue string, file *os.File, state *downloadState) error {
+	verify := min(state.Offset, verifyLength)
+	rangeStart := state.Offset - verify
+
+	response, size, err := requestRange(ctx, client, rawDiskUrl, headerKey, headerValue, rangeStart, rangeStart+max(verify, 1)-1)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if state.Size != 0 && state.Size != size {
+		return fmt.Errorf("%w: size changed from %d to %d bytes", errRestart, state.Size, size)
+	}
+	state.Size = size
+
+	if verify > 0 {
+		return verifyRange(response.Body, file, rangeStart, verify)
+	}
+	return nil
+}
+
+// fetchSegment downloads the bytes from start to end of the disk, and retries the whole
+// segment when it's interrupted.
+func fetchSegment(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue string, file *os.File, start, end int64, retries int, reporter *progress.Reporter) error {
+	for attempt := 0; ; attempt++ {
+		err := writeSegment(ctx, client, rawDiskUrl, headerKey, headerValue, file, start, end, reporter)
+		if err == nil {
+			return nil
+		}
+
+		if !isRetryable(err) || attempt >= retries || ctx.Err() != nil {
+			return err
+		}
+
+		interval := getRetryInterval(attempt)
+		log.Printf("Download of segment at %d bytes interrupted, retrying in %s: %v", start, interval, err)
+
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+	}
+}
+
+// writeSegment writes the segment to the file. The bytes of an interrupted segment are
+// removed from the progress, as the segment is downloaded again.
+func writeSegment(ctx context.Context, client *http.Client, rawDiskUrl, headerKey, headerValue string, file *os.File, start, end int64, reporter *progress.Reporter) (err error) {
+	response, _, err := requestRange(ctx, client, rawDiskUrl, headerKey, headerValue, start, end)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	offset := start
+	defer func() {
+		if err != nil {
+			reporter.Add(start - offset)
+		}
+	}()
+
+	buffer := make([]byte, copyBufferSize)
+	for offset <= end {
+		n, readErr := io.ReadFull(response.Body, buffer[:min(int64(len(buffer)), end-offset+1)])
+		if n > 0 {
+			// Zeros are skipped, so the scratch file stays sparse.
+			if !bytes.Equal(buffer[:n], zeros[:n]) {
+				if _, err := file.WriteAt(buffer[:n], offset); err != nil {
+					return err
+				}
+			}
+			offset += int64(n)
+			reporter.Add(int64(n))
+		}
+
+		if readErr != nil && offset <= end {
+			return &ShortReadError{Expected: end - start + 1, Received: offset - start, Err: readErr}
+		}
+	}
+	return nil
+}
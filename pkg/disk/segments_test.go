@@ -0,0 +1,178 @@
+package disk
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testSegmentSize int64 = 1024 * 1024
+
+func TestDownloadRawDiskImageSegmentsOutOfOrder(t *testing.T) {
+	data := newTestData(4 * int(testSegmentSize))
+	server := newExportServer(t, data)
+	server.handle = func(w http.ResponseWriter, request *http.Request, count int) bool {
+		// The first segment finishes last.
+		if request.Header.Get("Range") == "bytes=0-1048575" {
+			time.Sleep(300 * time.Millisecond)
+		}
+		return false
+	}
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := DownloadRawDiskImageSegments(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, 4, testSegmentSize, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	if state := readTestState(t, rawDiskPath); state.Offset != int64(len(data)) {
+		t.Fatalf("state is at %d bytes, expected %d", state.Offset, len(data))
+	}
+
+	// The segment of zeros isn't written, so it takes no space.
+	var stat syscall.Stat_t
+	if err := syscall.Stat(rawDiskPath, &stat); err != nil {
+		t.Fatal(err)
+	}
+	if allocated := stat.Blocks * 512; allocated > int64(len(data))-testSegmentSize {
+		t.Fatalf("%d bytes are allocated, expected at most %d", allocated, int64(len(data))-testSegmentSize)
+	}
+}
+
+func TestDownloadRawDiskImageSegmentsCommitContiguous(t *testing.T) {
+	data := newTestData(4 * int(testSegmentSize))
+	server := newExportServer(t, data)
+	server.handle = func(w http.ResponseWriter, request *http.Request, count int) bool {
+		// The first segment fails once the others are done.
+		if request.Header.Get("Range") == "bytes=0-1048575" {
+			time.Sleep(300 * time.Millisecond)
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return false
+	}
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := DownloadRawDiskImageSegments(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, 4, testSegmentSize, newTestReporter(t))
+
+	var statusError *HTTPStatusError
+	if !errors.As(err, &statusError) || statusError.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden error, got %v", err)
+	}
+
+	// The offset doesn't move past the missing first segment.
+	if state := readTestState(t, rawDiskPath); state.Offset != 0 {
+		t.Fatalf("state is at %d bytes, expected 0", state.Offset)
+	}
+}
+
+func TestDownloadRawDiskImageSegmentsResume(t *testing.T) {
+	data := newTestData(4 * int(testSegmentSize))
+	server := newExportServer(t, data)
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	offset := 2 * testSegmentSize
+	if err := os.WriteFile(rawDiskPath, data[:offset], 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestState(t, rawDiskPath, downloadState{Key: testKey, Size: int64(len(data)), Offset: offset})
+
+	err := DownloadRawDiskImageSegments(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, 2, testSegmentSize, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	// The bytes before the offset are verified, and only the segments after it downloaded.
+	for _, request := range server.getRequests() {
+		switch request {
+		case "bytes=1048576-2097151", "bytes=2097152-3145727", "bytes=3145728-4194303":
+		default:
+			t.Fatalf("unexpected request %q", request)
+		}
+	}
+}
+
+func TestDownloadRawDiskImageSegmentsVerifyMismatch(t *testing.T) {
+	data := newTestData(4 * int(testSegmentSize))
+	server := newExportServer(t, data)
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	offset := 2 * testSegmentSize
+	existing := bytes.Clone(data[:offset])
+	existing[offset-1] ^= 0xff
+	if err := os.WriteFile(rawDiskPath, existing, 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestState(t, rawDiskPath, downloadState{Key: testKey, Size: int64(len(data)), Offset: offset})
+
+	err := DownloadRawDiskImageSegments(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 0, 2, testSegmentSize, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The download starts over, and every segment is downloaded.
+	checkTestDisk(t, rawDiskPath, data)
+
+	requests := strings.Join(server.getRequests(), ",")
+	if !strings.Contains(requests, "bytes=0-1048575") {
+		t.Fatalf("first segment not downloaded again: %s", requests)
+	}
+}
+
+func TestDownloadRawDiskImageSegmentsIgnoredRange(t *testing.T) {
+	data := newTestData(4 * int(testSegmentSize))
+	server := newExportServer(t, data)
+	server.ignoreRange = true
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := DownloadRawDiskImageSegments(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 3, 4, testSegmentSize, newTestReporter(t))
+	if !errors.Is(err, errRangeNotSupported) {
+		t.Fatalf("expected Range not supported error, got %v", err)
+	}
+
+	if requests := server.getRequests(); len(requests) != 1 {
+		t.Fatalf("unexpected requests %q", requests)
+	}
+}
+
+func TestDownloadRawDiskImageSegmentsTruncatedSegment(t *testing.T) {
+	data := newTestData(4 * int(testSegmentSize))
+	server := newExportServer(t, data)
+	var truncated atomic.Bool
+	server.handle = func(w http.ResponseWriter, request *http.Request, count int) bool {
+		// The last segment is truncated once, and retried as a whole.
+		if request.Header.Get("Range") == "bytes=3145728-4194303" && !truncated.Swap(true) {
+			w.Header().Set("Content-Range", "bytes 3145728-4194303/4194304")
+			w.Header().Set("Content-Length", "1048576")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[3145728 : 3145728+1024])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		return false
+	}
+	rawDiskPath := filepath.Join(t.TempDir(), "disk.img.raw")
+
+	err := DownloadRawDiskImageSegments(context.Background(), server.Client(), server.URL, testHeaderKey, testHeaderValue, rawDiskPath, testKey, 1, 1, testSegmentSize, newTestReporter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTestDisk(t, rawDiskPath, data)
+
+	if requests := strings.Count(strings.Join(server.getRequests(), ","), "bytes=3145728-4194303"); requests != 2 {
+		t.Fatalf("last segment requested %d times, expected 2", requests)
+	}
+}
@@ -0,0 +1,37 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// NewClient returns a client for the VirtualMachineExport server, trusting the certificates
+// of the pool, or the system roots if it's nil. The optional resolve entry (HOST:PORT:ADDRESS)
+// makes the client connect to another address, e.g. a port-forward.
+func NewClient(certPool *x509.CertPool, resolve string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: certPool}
+
+	if resolve != "" {
+		separator := strings.LastIndex(resolve, ":")
+		if separator == -1 {
+			return nil, fmt.Errorf("invalid resolve entry: %s", resolve)
+		}
+		hostPort, address := resolve[:separator], resolve[separator+1:]
+
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if addr == hostPort {
+				_, port, _ := net.SplitHostPort(addr)
+				addr = net.JoinHostPort(address, port)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		}
+	}
+	return &http.Client{Transport: transport}, nil
+}
@@ -1,48 +1,367 @@
 package image
 
 import (
+	archivetar "archive/tar"
 	"context"
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/codingben/kubevirt-disk-uploader/pkg/progress"
+
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/static"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
 
 	tar "kubevirt.io/containerdisks/pkg/build"
 )
 
-func Build(diskPath string) (v1.Image, error) {
-	layer, err := tarball.LayerFromOpener(tar.StreamLayerOpener(diskPath))
+const (
+	AccessKeyIdEnv string = "ACCESS_KEY_ID"
+	SecretKeyEnv   string = "SECRET_KEY"
+)
+
+const (
+	SourceNamePlaceholder      string = "{vm}"
+	SourceNamespacePlaceholder string = "{namespace}"
+	VolumePlaceholder          string = "{volume}"
+)
+
+func GetImageDestination(imageDestination, sourceNamespace, sourceName, volumeName string) string {
+	replacer := strings.NewReplacer(
+		SourceNamePlaceholder, sourceName,
+		SourceNamespacePlaceholder, sourceNamespace,
+		VolumePlaceholder, volumeName,
+	)
+	return replacer.Replace(imageDestination)
+}
+
+const (
+	// DiskFileName is the name of the disk in the layer built by containerdisks.
+	DiskFileName string = "disk/disk.img"
+	// SourceDigestAnnotation is the digest of the raw disk downloaded from the export
+	// server, which the disk was converted from.
+	SourceDigestAnnotation string = "kubevirt-disk-uploader/source-raw-digest"
+)
+
+// DiskImage is the container disk image. Checksum is the SHA-256 of the disk, computed
+// while it's streamed into the layer, and stored as the shasum label.
+type DiskImage struct {
+	v1.Image
+	Checksum  string
+	diskPath  string
+	checksums *checksums
+}
+
+// Build builds the OCI image of the disk. The layer is streamed twice while it's built,
+// and the disk must have the same checksum both times. The source digest is optional.
+func Build(diskPath, sourceDigest string) (*DiskImage, error) {
+	checksums := &checksums{}
+
+	layer, err := tarball.LayerFromOpener(checksumOpener(tar.StreamLayerOpener(diskPath), checksums), tarball.WithMediaType(types.OCILayer))
 	if err != nil {
-		log.Fatalf("Error creating layer from file: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("error creating layer from file: %w", err)
 	}
 
-	image, err := mutate.AppendLayers(empty.Image, layer)
+	checksum, err := checksums.get()
 	if err != nil {
-		log.Fatalf("Error appending layer: %v", err)
 		return nil, err
 	}
-	return image, nil
+
+	// Annotations are part of OCI manifests only.
+	image := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	image = mutate.ConfigMediaType(image, types.OCIConfigJSON)
+
+	image, err = mutate.AppendLayers(image, layer)
+	if err != nil {
+		return nil, fmt.Errorf("error appending layer: %w", err)
+	}
+
+	image, err = mutate.Config(image, tar.ContainerDiskConfig(checksum, nil))
+	if err != nil {
+		return nil, fmt.Errorf("error setting config: %w", err)
+	}
+
+	if sourceDigest != "" {
+		image = mutate.Annotations(image, map[string]string{SourceDigestAnnotation: sourceDigest}).(v1.Image)
+	}
+	return &DiskImage{Image: image, Checksum: checksum, diskPath: diskPath, checksums: checksums}, nil
+}
+
+// Verify checks the disk had the checksum of the label every time it was streamed into
+// the layer, e.g. while it was pushed, and still has it on the scratch space. The layer
+// isn't streamed by the push when the registry already has it, so the disk is read again.
+func (d *DiskImage) Verify() error {
+	checksum, err := d.checksums.get()
+	if err != nil {
+		return err
+	}
+
+	if checksum != d.Checksum {
+		return fmt.Errorf("disk checksum %s doesn't match the shasum label %s", checksum, d.Checksum)
+	}
+
+	checksum, err = getFileChecksum(d.diskPath)
+	if err != nil {
+		return err
+	}
+
+	if checksum != d.Checksum {
+		return fmt.Errorf("checksum %s of disk file doesn't match the shasum label %s", checksum, d.Checksum)
+	}
+	return nil
+}
+
+func getFileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksums records the checksum of the disk every time the layer is streamed.
+type checksums struct {
+	mutex     sync.Mutex
+	checksums []string
+}
+
+func (c *checksums) add(checksum string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.checksums = append(c.checksums, checksum)
+}
+
+// get returns the checksum of the disk, or an error if it changed between the streams.
+func (c *checksums) get() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(c.checksums) == 0 {
+		return "", fmt.Errorf("disk was not streamed into the layer")
+	}
+
+	for _, checksum := range c.checksums[1:] {
+		if checksum != c.checksums[0] {
+			return "", fmt.Errorf("disk changed while it was streamed into the layer: checksum %s, then %s", c.checksums[0], checksum)
+		}
+	}
+	return c.checksums[len(c.checksums)-1], nil
+}
+
+// checksumOpener computes the checksum of the disk in the tar stream of the layer, while
+// the stream is read. Streams which aren't read until the end aren't recorded.
+func checksumOpener(opener tarball.Opener, checksums *checksums) tarball.Opener {
+	return func() (io.ReadCloser, error) {
+		stream, err := opener()
+		if err != nil {
+			return nil, err
+		}
+
+		pipeReader, pipeWriter := io.Pipe()
+		go func() {
+			defer stream.Close()
+
+			checksum, err := readDiskChecksum(io.TeeReader(stream, pipeWriter))
+			if err == nil {
+				// Pass on what follows the end of the archive.
+				_, err = io.Copy(pipeWriter, stream)
+			}
+
+			if err == nil {
+				checksums.add(checksum)
+			}
+			pipeWriter.CloseWithError(err)
+		}()
+		return pipeReader, nil
+	}
+}
+
+func readDiskChecksum(stream io.Reader) (string, error) {
+	checksum := ""
+	tarReader := archivetar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if header.Name != DiskFileName {
+			continue
+		}
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, tarReader); err != nil {
+			return "", err
+		}
+		checksum = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	if checksum == "" {
+		return "", fmt.Errorf("disk not found in layer")
+	}
+	return checksum, nil
 }
 
-func Push(image v1.Image, imageDestination string, pushTimeout int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*time.Duration(pushTimeout))
+const (
+	ManifestsArtifactType types.MediaType = "application/vnd.kubevirt.manifests.config.v1+json"
+	ManifestsLayerType    types.MediaType = "application/vnd.kubevirt.manifests.v1+yaml"
+)
+
+// BuildManifestsArtifact builds an OCI artifact holding the manifests, which refers
+// to the subject image, so it's listed by the referrers API of the registry.
+func BuildManifestsArtifact(manifests []byte, subject v1.Descriptor) (v1.Image, error) {
+	artifact := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	artifact = mutate.ConfigMediaType(artifact, ManifestsArtifactType)
+
+	artifact, err := mutate.AppendLayers(artifact, static.NewLayer(manifests, ManifestsLayerType))
+	if err != nil {
+		return nil, fmt.Errorf("error appending layer: %w", err)
+	}
+
+	artifact, ok := mutate.Subject(artifact, subject).(v1.Image)
+	if !ok {
+		return nil, fmt.Errorf("error setting subject of artifact")
+	}
+	return artifact, nil
+}
+
+// PushManifests pushes the manifests as a referrer of the already pushed image.
+func PushManifests(ctx context.Context, manifests []byte, imageDestination string, pushTimeout int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*time.Duration(pushTimeout))
+	defer cancel()
+
+	options := []crane.Option{crane.WithAuth(getAuth()), crane.WithContext(ctx)}
+	subject, err := crane.Head(imageDestination, options...)
+	if err != nil {
+		return fmt.Errorf("error getting pushed image: %w", err)
+	}
+
+	artifact, err := BuildManifestsArtifact(manifests, *subject)
+	if err != nil {
+		return err
+	}
+
+	digest, err := artifact.Digest()
+	if err != nil {
+		return err
+	}
+
+	reference, err := name.ParseReference(imageDestination)
+	if err != nil {
+		return err
+	}
+
+	err = crane.Push(artifact, reference.Context().Digest(digest.String()).String(), options...)
+	if err != nil {
+		return fmt.Errorf("error pushing manifests: %w", err)
+	}
+	return nil
+}
+
+// Push pushes the image by digest, without tagging it, and sets the progress from the
+// updates of the upload, which cover the layers missing in the registry. The image is
+// tagged by Tag once it's verified.
+func Push(ctx context.Context, image v1.Image, imageDestination string, pushTimeout int, reporter *progress.Reporter) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*time.Duration(pushTimeout))
+	defer cancel()
+
+	reference, err := getDigestReference(image, imageDestination)
+	if err != nil {
+		return err
+	}
+
+	updates := make(chan v1.Update, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for update := range updates {
+			reporter.SetTotal(update.Total)
+			reporter.Set(update.Complete)
+		}
+	}()
+
+	withProgress := func(o *crane.Options) {
+		o.Remote = append(o.Remote, remote.WithProgress(updates))
+	}
+
+	err = crane.Push(image, reference, crane.WithAuth(getAuth()), crane.WithContext(ctx), withProgress)
+	if err != nil {
+		return fmt.Errorf("error pushing image: %w", err)
+	}
+
+	// The updates are closed once the image is written, but not when the push fails early.
+	<-done
+	return nil
+}
+
+// Tag points the tag of the image destination to the image pushed by Push. Destinations
+// without a tag, i.e. digests, are left as they are.
+func Tag(ctx context.Context, image v1.Image, imageDestination string, pushTimeout int) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute*time.Duration(pushTimeout))
 	defer cancel()
 
-	auth := &authn.Basic{
-		Username: os.Getenv("ACCESS_KEY_ID"),
-		Password: os.Getenv("SECRET_KEY"),
+	reference, err := name.ParseReference(imageDestination)
+	if err != nil {
+		return err
+	}
+
+	tag, ok := reference.(name.Tag)
+	if !ok {
+		return nil
 	}
-	err := crane.Push(image, imageDestination, crane.WithAuth(auth), crane.WithContext(ctx))
+
+	digestReference, err := getDigestReference(image, imageDestination)
 	if err != nil {
-		log.Fatalf("Error pushing image: %v", err)
 		return err
 	}
+
+	err = crane.Tag(digestReference, tag.TagStr(), crane.WithAuth(getAuth()), crane.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("error tagging image: %w", err)
+	}
 	return nil
 }
+
+// getDigestReference returns the reference of the image by digest in the repository of
+// the image destination.
+func getDigestReference(image v1.Image, imageDestination string) (string, error) {
+	digest, err := image.Digest()
+	if err != nil {
+		return "", err
+	}
+
+	reference, err := name.ParseReference(imageDestination)
+	if err != nil {
+		return "", err
+	}
+	return reference.Context().Digest(digest.String()).String(), nil
+}
+
+func getAuth() authn.Authenticator {
+	return &authn.Basic{
+		Username: os.Getenv(AccessKeyIdEnv),
+		Password: os.Getenv(SecretKeyEnv),
+	}
+}
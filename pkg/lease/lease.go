@@ -0,0 +1,220 @@
+package lease
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+const (
+	leaseNamePrefix string = "kubevirt-disk-uploader"
+	// The Lease expires when a crashed run stops renewing it, so the next run can take it over.
+	leaseDuration   = 60 * time.Second
+	renewInterval   = 20 * time.Second
+	acquireInterval = 5 * time.Second
+	// concurrentHolder is reported when another run acquired the Lease at the same time.
+	concurrentHolder string = "another run"
+)
+
+// Lock is a Lease on an export source, held by a single run at a time, so concurrent
+// runs don't export the same source.
+type Lock struct {
+	client    kubecli.KubevirtClient
+	namespace string
+	name      string
+	holder    string
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// AcquireLock acquires the Lease on the export source and keeps renewing it until it's
+// released. If another run holds it, it waits up to the timeout, or fails right away
+// without timeout.
+func AcquireLock(ctx context.Context, client kubecli.KubevirtClient, namespace, exportSourceKind, exportSourceName, holder string, owner *ownerreference.Owner, timeout time.Duration) (*Lock, error) {
+	lock := &Lock{
+		client:    client,
+		namespace: namespace,
+		name:      getLeaseName(exportSourceKind, exportSourceName),
+		holder:    holder,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	acquired, leaseHolder, err := lock.tryAcquire(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	if !acquired && timeout == 0 {
+		return nil, fmt.Errorf("export source '%s/%s' is locked by '%s', which is exporting it, use --lock-timeout to wait", namespace, exportSourceName, leaseHolder)
+	}
+
+	if !acquired {
+		log.Printf("Export source '%s/%s' is locked by '%s', waiting...", namespace, exportSourceName, leaseHolder)
+
+		poller := func(ctx context.Context) (bool, error) {
+			acquired, _, err := lock.tryAcquire(owner)
+			return acquired, err
+		}
+
+		if err := wait.PollUntilContextTimeout(ctx, acquireInterval, timeout, false, poller); err != nil {
+			return nil, fmt.Errorf("failed to lock export source '%s/%s': %w", namespace, exportSourceName, err)
+		}
+	}
+
+	go lock.renew()
+	return lock, nil
+}
+
+// Release stops renewing the Lease and deletes it, unless another run took it over.
+func (l *Lock) Release() error {
+	close(l.stop)
+	<-l.done
+
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(context.Background(), l.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !isHeldBy(lease, l.holder) {
+		return nil
+	}
+
+	preconditions := metav1.Preconditions{UID: &lease.UID, ResourceVersion: &lease.ResourceVersion}
+	err = l.client.CoordinationV1().Leases(l.namespace).Delete(context.Background(), l.name, metav1.DeleteOptions{Preconditions: &preconditions})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// tryAcquire creates the Lease, or takes it over when it expired. It returns the holder
+// of the Lease when another run holds it.
+func (l *Lock) tryAcquire(owner *ownerreference.Owner) (bool, string, error) {
+	now := metav1.NewMicroTime(time.Now())
+	leaseDurationSeconds := int32(leaseDuration.Seconds())
+
+	lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(context.Background(), l.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      l.name,
+				Namespace: l.namespace,
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &l.holder,
+				LeaseDurationSeconds: &leaseDurationSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		ownerreference.SetOwnerReference(lease, owner)
+
+		_, err = l.client.CoordinationV1().Leases(l.namespace).Create(context.Background(), lease, metav1.CreateOptions{})
+		if errors.IsAlreadyExists(err) {
+			return false, concurrentHolder, nil
+		}
+		return err == nil, "", err
+	}
+	if err != nil {
+		return false, "", err
+	}
+
+	if !isHeldBy(lease, l.holder) && !isExpired(lease) {
+		return false, getHolder(lease), nil
+	}
+
+	lease.Spec.HolderIdentity = &l.holder
+	lease.Spec.LeaseDurationSeconds = &leaseDurationSeconds
+	lease.Spec.AcquireTime = &now
+	lease.Spec.RenewTime = &now
+	ownerreference.SetOwnerReference(lease, owner)
+
+	_, err = l.client.CoordinationV1().Leases(l.namespace).Update(context.Background(), lease, metav1.UpdateOptions{})
+	if errors.IsConflict(err) {
+		return false, concurrentHolder, nil
+	}
+	return err == nil, "", err
+}
+
+func (l *Lock) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(renewInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		lease, err := l.client.CoordinationV1().Leases(l.namespace).Get(context.Background(), l.name, metav1.GetOptions{})
+		if err != nil {
+			log.Printf("Failed to renew Lease '%s/%s': %v", l.namespace, l.name, err)
+			continue
+		}
+
+		if !isHeldBy(lease, l.holder) {
+			log.Printf("Lease '%s/%s' was taken over by '%s'", l.namespace, l.name, getHolder(lease))
+			continue
+		}
+
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.RenewTime = &now
+		if _, err := l.client.CoordinationV1().Leases(l.namespace).Update(context.Background(), lease, metav1.UpdateOptions{}); err != nil {
+			log.Printf("Failed to renew Lease '%s/%s': %v", l.namespace, l.name, err)
+		}
+	}
+}
+
+// getLeaseName returns the name of the Lease of the export source. Names too long for
+// a Lease are replaced by their hash.
+func getLeaseName(exportSourceKind, exportSourceName string) string {
+	name := fmt.Sprintf("%s-%s-%s", leaseNamePrefix, exportSourceKind, exportSourceName)
+	if len(name) <= validation.DNS1123SubdomainMaxLength {
+		return name
+	}
+	return fmt.Sprintf("%s-%s-%x", leaseNamePrefix, exportSourceKind, sha256.Sum256([]byte(exportSourceName)))
+}
+
+// getHolder returns the holder of the Lease, which is empty when it was released.
+func getHolder(lease *coordinationv1.Lease) string {
+	if lease.Spec.HolderIdentity == nil {
+		return ""
+	}
+	return *lease.Spec.HolderIdentity
+}
+
+func isHeldBy(lease *coordinationv1.Lease, holder string) bool {
+	return lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == holder
+}
+
+func isExpired(lease *coordinationv1.Lease) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return true
+	}
+
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+
+	expiration := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return time.Now().After(expiration)
+}
@@ -0,0 +1,118 @@
+package manifests
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	kvcorev1 "kubevirt.io/api/core/v1"
+)
+
+// DownloadManifests downloads the manifests from the VirtualMachineExport server.
+func DownloadManifests(ctx context.Context, client *http.Client, manifestUrl, headerKey, headerValue string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, manifestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set(headerKey, headerValue)
+	request.Header.Set("Accept", "application/yaml")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download manifests: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download manifests: %s", response.Status)
+	}
+	return io.ReadAll(response.Body)
+}
+
+// RewriteVolumes replaces the exported volumes of the VirtualMachine with container disks
+// of the pushed images, and drops the DataVolumes that would import them from the export.
+func RewriteVolumes(manifests []byte, imageDestinations map[string]string) ([]byte, error) {
+	reader := k8syaml.NewYAMLReader(bufio.NewReader(bytes.NewReader(manifests)))
+
+	var documents [][]byte
+	for {
+		document, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(document)) == 0 {
+			continue
+		}
+
+		object := &metav1.PartialObjectMetadata{}
+		if err := yaml.Unmarshal(document, object); err != nil {
+			return nil, err
+		}
+
+		switch object.Kind {
+		case "VirtualMachine":
+			document, err = rewriteVirtualMachine(document, imageDestinations)
+			if err != nil {
+				return nil, err
+			}
+		case "DataVolume":
+			if _, ok := imageDestinations[object.Name]; ok {
+				continue
+			}
+		}
+
+		if !bytes.HasSuffix(document, []byte("\n")) {
+			document = append(document, '\n')
+		}
+		documents = append(documents, document)
+	}
+	return bytes.Join(documents, []byte("---\n")), nil
+}
+
+func rewriteVirtualMachine(document []byte, imageDestinations map[string]string) ([]byte, error) {
+	vm := &kvcorev1.VirtualMachine{}
+	if err := yaml.Unmarshal(document, vm); err != nil {
+		return nil, err
+	}
+
+	if vm.Spec.Template != nil {
+		for i := range vm.Spec.Template.Spec.Volumes {
+			volume := &vm.Spec.Template.Spec.Volumes[i]
+
+			claimName := ""
+			switch {
+			case volume.DataVolume != nil:
+				claimName = volume.DataVolume.Name
+			case volume.PersistentVolumeClaim != nil:
+				claimName = volume.PersistentVolumeClaim.ClaimName
+			}
+
+			if destination, ok := imageDestinations[claimName]; ok {
+				volume.VolumeSource = kvcorev1.VolumeSource{
+					ContainerDisk: &kvcorev1.ContainerDiskSource{Image: destination},
+				}
+			}
+		}
+	}
+
+	var dataVolumeTemplates []kvcorev1.DataVolumeTemplateSpec
+	for _, template := range vm.Spec.DataVolumeTemplates {
+		if _, ok := imageDestinations[template.Name]; !ok {
+			dataVolumeTemplates = append(dataVolumeTemplates, template)
+		}
+	}
+	vm.Spec.DataVolumeTemplates = dataVolumeTemplates
+
+	return yaml.Marshal(vm)
+}
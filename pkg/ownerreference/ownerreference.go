@@ -4,10 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/restmapper"
 
 	kubecli "kubevirt.io/client-go/kubecli"
 )
@@ -17,6 +20,29 @@ const (
 	podNamespaceEnv = "POD_NAMESPACE"
 )
 
+const (
+	// ManagedByLabel marks the objects created by the uploader, so the ones left
+	// behind by a crashed run can be found and deleted.
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "kubevirt-disk-uploader"
+	// OwnerUIDLabel links the objects to their owner, which is the only link for
+	// objects in other namespaces, as owner references can't cross namespaces.
+	OwnerUIDLabel = "kubevirt-disk-uploader/owner-uid"
+	// RunIDLabel links the objects to the run that created them.
+	RunIDLabel = "kubevirt-disk-uploader/run-id"
+)
+
+// OwnerNone disables the owner, so the objects are deleted explicitly by the run only.
+const OwnerNone = "none"
+
+// Owner links the objects created by a run to the run, and to the object owning them.
+// Reference is nil if there is no owner.
+type Owner struct {
+	RunID     string
+	Namespace string
+	Reference *metav1.OwnerReference
+}
+
 func GetTaskRunPod(client kubecli.KubevirtClient) (*corev1.Pod, error) {
 	podName, isSet := os.LookupEnv(podNameEnv)
 	if !isSet {
@@ -33,14 +59,58 @@ func GetTaskRunPod(client kubecli.KubevirtClient) (*corev1.Pod, error) {
 	return pod, err
 }
 
-func SetPodOwnerReference(client kubecli.KubevirtClient, object metav1.Object) error {
-	pod, err := GetTaskRunPod(client)
+// GetOwner returns the owner of the objects created by the run. The owner is given as
+// kind/name (e.g. job/example), and is looked up in the namespace of the uploader, or
+// in the given namespace when running outside the cluster. By default, the pod of the
+// uploader is the owner. The reference is nil if there is no owner, e.g. without POD_NAME.
+func GetOwner(client kubecli.KubevirtClient, owner, namespace, runID string) (*Owner, error) {
+	var err error
+	result := &Owner{RunID: runID}
+	switch owner {
+	case OwnerNone:
+	case "":
+		if _, isSet := os.LookupEnv(podNameEnv); isSet {
+			result.Namespace, result.Reference, err = getPodOwner(client)
+		}
+	default:
+		if podNamespace := os.Getenv(podNamespaceEnv); podNamespace != "" {
+			namespace = podNamespace
+		}
+		result.Namespace = namespace
+		result.Reference, err = getObjectOwner(client, owner, namespace)
+	}
+
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return result, nil
+}
+
+// SetOwnerReference labels the object and makes the owner its owner. Objects without
+// an owner, or in other namespaces than the owner, get the labels only and are deleted
+// explicitly by the run instead.
+func SetOwnerReference(object metav1.Object, owner *Owner) {
+	labels := object.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[ManagedByLabel] = ManagedByValue
+	labels[RunIDLabel] = owner.RunID
+	if owner.Reference != nil {
+		labels[OwnerUIDLabel] = string(owner.Reference.UID)
+	}
+	object.SetLabels(labels)
 
-	if object.GetNamespace() != pod.GetNamespace() {
-		return fmt.Errorf("can't create owner reference for objects in different namespaces")
+	if owner.Reference == nil || object.GetNamespace() != owner.Namespace {
+		return
+	}
+	object.SetOwnerReferences([]metav1.OwnerReference{*owner.Reference})
+}
+
+func getPodOwner(client kubecli.KubevirtClient) (string, *metav1.OwnerReference, error) {
+	pod, err := GetTaskRunPod(client)
+	if err != nil {
+		return "", nil, err
 	}
 
 	scheme := runtime.NewScheme()
@@ -48,15 +118,50 @@ func SetPodOwnerReference(client kubecli.KubevirtClient, object metav1.Object) e
 
 	gvks, _, err := scheme.ObjectKinds(pod)
 	if err != nil {
-		return fmt.Errorf("could not get GroupVersionKind for object: %w", err)
+		return "", nil, fmt.Errorf("could not get GroupVersionKind for object: %w", err)
 	}
-	ref := metav1.OwnerReference{
+	ref := &metav1.OwnerReference{
 		APIVersion: gvks[0].GroupVersion().String(),
 		Kind:       gvks[0].Kind,
 		UID:        pod.GetUID(),
 		Name:       pod.GetName(),
 	}
+	return pod.GetNamespace(), ref, nil
+}
 
-	object.SetOwnerReferences([]metav1.OwnerReference{ref})
-	return nil
+func getObjectOwner(client kubecli.KubevirtClient, owner, namespace string) (*metav1.OwnerReference, error) {
+	kind, name, found := strings.Cut(owner, "/")
+	if !found || kind == "" || name == "" {
+		return nil, fmt.Errorf("invalid owner: %s, must be kind/name (e.g. job/example)", owner)
+	}
+
+	// The kind is resolved like kubectl does, so Job, jobs.batch or a short name all work.
+	groupResources, err := restmapper.GetAPIGroupResources(client.DiscoveryClient())
+	if err != nil {
+		return nil, err
+	}
+	mapper := restmapper.NewShortcutExpander(restmapper.NewDiscoveryRESTMapper(groupResources), client.DiscoveryClient(), nil)
+
+	gvr, err := mapper.ResourceFor(schema.ParseGroupResource(strings.ToLower(kind)).WithVersion(""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find owner kind '%s': %w", kind, err)
+	}
+
+	gvk, err := mapper.KindFor(gvr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find owner kind '%s': %w", kind, err)
+	}
+
+	object, err := client.DynamicClient().Resource(gvr).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	ref := &metav1.OwnerReference{
+		APIVersion: gvk.GroupVersion().String(),
+		Kind:       gvk.Kind,
+		UID:        object.GetUID(),
+		Name:       object.GetName(),
+	}
+	return ref, nil
 }
@@ -0,0 +1,122 @@
+package portforward
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+const (
+	localAddress     string = "127.0.0.1"
+	exportServerPort int    = 8443
+)
+
+// ForwardExportServer opens a port-forward through the Kubernetes API to the export
+// server pod behind the VirtualMachineExport Service, and returns the local port.
+// The port-forward is closed when the stop channel is closed.
+func ForwardExportServer(client kubecli.KubevirtClient, namespace, name string, stopChan chan struct{}) (uint16, error) {
+	pod, targetPort, err := getExportServerPod(client, namespace, name)
+	if err != nil {
+		return 0, err
+	}
+
+	transport, upgrader, err := spdy.RoundTripperFor(client.Config())
+	if err != nil {
+		return 0, err
+	}
+
+	request := client.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(pod.Namespace).
+		Name(pod.Name).
+		SubResource("portforward")
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, request.URL())
+
+	readyChan := make(chan struct{})
+	ports := []string{fmt.Sprintf("0:%d", targetPort)}
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{localAddress}, ports, stopChan, readyChan, io.Discard, log.Writer())
+	if err != nil {
+		return 0, err
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+	case err := <-errChan:
+		return 0, fmt.Errorf("failed to port-forward to pod '%s/%s': %w", pod.Namespace, pod.Name, err)
+	}
+
+	forwardedPorts, err := forwarder.GetPorts()
+	if err != nil {
+		return 0, err
+	}
+	return forwardedPorts[0].Local, nil
+}
+
+// GetForwardedUrl points the URL at the local port, and returns it together with the
+// curl resolve entry that maps the original host name to the local address, so the
+// export server certificate is still verified against the host name.
+func GetForwardedUrl(rawUrl string, localPort uint16) (string, string, error) {
+	parsedUrl, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", "", err
+	}
+
+	host := parsedUrl.Hostname()
+	port := strconv.Itoa(int(localPort))
+	parsedUrl.Host = net.JoinHostPort(host, port)
+
+	resolve := fmt.Sprintf("%s:%s:%s", host, port, localAddress)
+	return parsedUrl.String(), resolve, nil
+}
+
+func getExportServerPod(client kubecli.KubevirtClient, namespace, name string) (*corev1.Pod, int, error) {
+	vmExport, err := client.VirtualMachineExport(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if vmExport.Status == nil || vmExport.Status.ServiceName == "" {
+		return nil, 0, fmt.Errorf("no service found in VirtualMachineExport '%s/%s' status", namespace, name)
+	}
+
+	service, err := client.CoreV1().Services(namespace).Get(context.Background(), vmExport.Status.ServiceName, metav1.GetOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	targetPort := exportServerPort
+	if len(service.Spec.Ports) > 0 && service.Spec.Ports[0].TargetPort.IntValue() != 0 {
+		targetPort = service.Spec.Ports[0].TargetPort.IntValue()
+	}
+
+	selector := labels.SelectorFromSet(service.Spec.Selector).String()
+	pods, err := client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range pods.Items {
+		if pods.Items[i].Status.Phase == corev1.PodRunning {
+			return &pods.Items[i], targetPort, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("no running export server pod found for Service '%s/%s'", namespace, service.Name)
+}
@@ -0,0 +1,336 @@
+package preflight
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/image"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/vmexport"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+const (
+	vmExportFeatureGate string = "VMExport"
+)
+
+type Status string
+
+const (
+	Pass Status = "PASS"
+	Warn Status = "WARN"
+	Fail Status = "FAIL"
+)
+
+type Check struct {
+	Name    string
+	Status  Status
+	Message string
+}
+
+type Options struct {
+	ExportSourceKind      string
+	ExportSourceNamespace string
+	ExportSourceName      string
+	VolumeName            string
+	AllVolumes            bool
+	ScratchPath           string
+	SnapshotFirst         bool
+	StopVM                bool
+	PortForward           bool
+	Owner                 string
+}
+
+type permission struct {
+	group       string
+	resource    string
+	subresource string
+	verb        string
+}
+
+// Run checks everything the export needs before any object is created in the cluster.
+func Run(client kubecli.KubevirtClient, opts Options) []Check {
+	kind, namespace, name, sourceCheck := checkExportSource(client, opts)
+	return []Check{
+		sourceCheck,
+		checkVolume(client, opts, kind, namespace, name),
+		checkExportFeatureGate(client),
+		checkPermissions(client, opts, kind, namespace),
+		checkOwner(client, opts),
+		checkScratchSpace(opts.ScratchPath),
+		checkRegistryCredentials(),
+	}
+}
+
+func Passed(checks []Check) bool {
+	for _, check := range checks {
+		if check.Status == Fail {
+			return false
+		}
+	}
+	return true
+}
+
+func PrintReport(w io.Writer, checks []Check) {
+	for _, check := range checks {
+		fmt.Fprintf(w, "[%s] %s: %s\n", check.Status, check.Name, check.Message)
+	}
+}
+
+func checkExportSource(client kubecli.KubevirtClient, opts Options) (string, string, string, Check) {
+	check := Check{Name: "Export source"}
+
+	kind, namespace, name, err := vmexport.ResolveExportSource(client, opts.ExportSourceKind, opts.ExportSourceNamespace, opts.ExportSourceName)
+	if err != nil {
+		check.Status, check.Message = Fail, err.Error()
+		return "", "", "", check
+	}
+
+	if err := vmexport.CheckExportSourceExists(client, kind, namespace, name); err != nil {
+		check.Status, check.Message = Fail, err.Error()
+		return "", "", "", check
+	}
+
+	check.Status, check.Message = Pass, fmt.Sprintf("%s '%s/%s' exists", kind, namespace, name)
+	return kind, namespace, name, check
+}
+
+func checkVolume(client kubecli.KubevirtClient, opts Options, kind, namespace, name string) Check {
+	check := Check{Name: "Volume"}
+
+	switch {
+	case kind == "":
+		check.Status, check.Message = Fail, "export source not found"
+	case opts.AllVolumes:
+		check.Status, check.Message = Pass, "all volumes are exported"
+	case vmexport.GetDefaultVolumeName(kind, name) != "" || vmexport.IsVolumeSnapshotSource(kind):
+		check.Status, check.Message = Pass, "volume name is set automatically"
+	case opts.VolumeName == "":
+		check.Status, check.Message = Fail, fmt.Sprintf("volume name must be set for export source kind '%s'", opts.ExportSourceKind)
+	case vmexport.IsVirtualMachineSource(kind):
+		vm, err := client.VirtualMachine(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			check.Status, check.Message = Fail, err.Error()
+			return check
+		}
+
+		var claimNames []string
+		if vm.Spec.Template != nil {
+			for _, volume := range vm.Spec.Template.Spec.Volumes {
+				switch {
+				case volume.DataVolume != nil:
+					claimNames = append(claimNames, volume.DataVolume.Name)
+				case volume.PersistentVolumeClaim != nil:
+					claimNames = append(claimNames, volume.PersistentVolumeClaim.ClaimName)
+				}
+			}
+		}
+
+		if !slices.Contains(claimNames, opts.VolumeName) {
+			check.Status, check.Message = Fail, fmt.Sprintf("volume '%s' is not found in VirtualMachine spec, exportable volumes are: %s", opts.VolumeName, strings.Join(claimNames, ", "))
+			return check
+		}
+		check.Status, check.Message = Pass, fmt.Sprintf("volume '%s' is found in VirtualMachine spec", opts.VolumeName)
+	default:
+		check.Status, check.Message = Warn, fmt.Sprintf("volume '%s' can be checked only once the export is ready", opts.VolumeName)
+	}
+	return check
+}
+
+func checkExportFeatureGate(client kubecli.KubevirtClient) Check {
+	check := Check{Name: "VMExport feature gate"}
+
+	kubevirts, err := client.KubeVirt(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		check.Status, check.Message = Warn, fmt.Sprintf("failed to read KubeVirt CR: %v", err)
+		return check
+	}
+
+	for _, kubevirt := range kubevirts.Items {
+		configuration := kubevirt.Spec.Configuration.DeveloperConfiguration
+		if configuration != nil && slices.Contains(configuration.FeatureGates, vmExportFeatureGate) {
+			check.Status, check.Message = Pass, fmt.Sprintf("enabled in KubeVirt CR '%s/%s'", kubevirt.Namespace, kubevirt.Name)
+			return check
+		}
+	}
+
+	check.Status, check.Message = Fail, fmt.Sprintf("feature gate '%s' is not enabled in KubeVirt CR", vmExportFeatureGate)
+	return check
+}
+
+func checkPermissions(client kubecli.KubevirtClient, opts Options, kind, namespace string) Check {
+	check := Check{Name: "Permissions"}
+
+	if namespace == "" {
+		namespace = opts.ExportSourceNamespace
+	}
+
+	var missing []string
+	for _, permission := range getRequiredPermissions(opts, kind) {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Group:       permission.group,
+					Resource:    permission.resource,
+					Subresource: permission.subresource,
+					Verb:        permission.verb,
+				},
+			},
+		}
+
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), review, metav1.CreateOptions{})
+		if err != nil {
+			check.Status, check.Message = Fail, err.Error()
+			return check
+		}
+
+		if !review.Status.Allowed {
+			missing = append(missing, permission.String())
+		}
+	}
+
+	if len(missing) > 0 {
+		check.Status, check.Message = Fail, fmt.Sprintf("missing permissions in namespace '%s': %s", namespace, strings.Join(missing, ", "))
+		return check
+	}
+	check.Status, check.Message = Pass, fmt.Sprintf("all permissions are granted in namespace '%s'", namespace)
+	return check
+}
+
+func getRequiredPermissions(opts Options, kind string) []permission {
+	permissions := []permission{
+		{group: "export.kubevirt.io", resource: "virtualmachineexports", verb: "get"},
+		{group: "export.kubevirt.io", resource: "virtualmachineexports", verb: "list"},
+		{group: "export.kubevirt.io", resource: "virtualmachineexports", verb: "watch"},
+		{group: "export.kubevirt.io", resource: "virtualmachineexports", verb: "create"},
+		{group: "export.kubevirt.io", resource: "virtualmachineexports", verb: "delete"},
+		{resource: "secrets", verb: "get"},
+		{resource: "secrets", verb: "create"},
+		{resource: "secrets", verb: "delete"},
+		{group: "coordination.k8s.io", resource: "leases", verb: "get"},
+		{group: "coordination.k8s.io", resource: "leases", verb: "create"},
+		{group: "coordination.k8s.io", resource: "leases", verb: "update"},
+		{group: "coordination.k8s.io", resource: "leases", verb: "delete"},
+	}
+
+	if group, resource, err := vmexport.GetExportSourceResource(opts.ExportSourceKind); err == nil {
+		permissions = append(permissions, permission{group: group, resource: resource, verb: "get"})
+	}
+
+	// DataVolumes and DataSources are exported through the PVC or VolumeSnapshot they're
+	// backed by, which is read as well.
+	if kind != opts.ExportSourceKind {
+		if group, resource, err := vmexport.GetExportSourceResource(kind); err == nil {
+			permissions = append(permissions, permission{group: group, resource: resource, verb: "get"})
+		}
+	}
+
+	if vmexport.IsVolumeSnapshotSource(kind) {
+		permissions = append(permissions,
+			permission{resource: "persistentvolumeclaims", verb: "list"},
+			permission{resource: "persistentvolumeclaims", verb: "create"},
+			permission{resource: "persistentvolumeclaims", verb: "delete"},
+		)
+	}
+
+	if opts.SnapshotFirst {
+		permissions = append(permissions,
+			permission{group: "snapshot.kubevirt.io", resource: "virtualmachinesnapshots", verb: "create"},
+			permission{group: "snapshot.kubevirt.io", resource: "virtualmachinesnapshots", verb: "delete"},
+		)
+	}
+
+	if opts.StopVM {
+		permissions = append(permissions,
+			permission{group: "kubevirt.io", resource: "virtualmachines", verb: "list"},
+			permission{group: "kubevirt.io", resource: "virtualmachines", verb: "patch"},
+			permission{group: "kubevirt.io", resource: "virtualmachineinstances", verb: "get"},
+			permission{group: "subresources.kubevirt.io", resource: "virtualmachines", subresource: "start", verb: "update"},
+		)
+	}
+
+	if opts.PortForward {
+		permissions = append(permissions,
+			permission{resource: "services", verb: "get"},
+			permission{resource: "pods", verb: "list"},
+			permission{resource: "pods", subresource: "portforward", verb: "create"},
+		)
+	}
+	return permissions
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource = fmt.Sprintf("%s/%s", resource, p.subresource)
+	}
+	if p.group != "" {
+		resource = fmt.Sprintf("%s.%s", resource, p.group)
+	}
+	return fmt.Sprintf("%s %s", p.verb, resource)
+}
+
+func checkOwner(client kubecli.KubevirtClient, opts Options) Check {
+	check := Check{Name: "Owner"}
+
+	owner, err := ownerreference.GetOwner(client, opts.Owner, opts.ExportSourceNamespace, "")
+	switch {
+	case err != nil:
+		check.Status, check.Message = Fail, err.Error()
+	case owner.Reference == nil:
+		check.Status, check.Message = Warn, "no owner, objects left behind by a crashed run are not garbage collected"
+	default:
+		check.Status, check.Message = Pass, fmt.Sprintf("%s '%s/%s' owns the created objects", owner.Reference.Kind, owner.Namespace, owner.Reference.Name)
+	}
+	return check
+}
+
+func checkScratchSpace(scratchPath string) Check {
+	check := Check{Name: "Scratch space"}
+
+	file, err := os.CreateTemp(scratchPath, ".preflight-")
+	if err != nil {
+		check.Status, check.Message = Fail, fmt.Sprintf("'%s' is not writable: %v", scratchPath, err)
+		return check
+	}
+	file.Close()
+	os.Remove(file.Name())
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(scratchPath, &stat); err != nil {
+		check.Status, check.Message = Warn, fmt.Sprintf("failed to get free space of '%s': %v", scratchPath, err)
+		return check
+	}
+
+	free := stat.Bavail * uint64(stat.Bsize)
+	check.Status, check.Message = Pass, fmt.Sprintf("'%s' is writable with %d MiB free", scratchPath, free/1024/1024)
+	return check
+}
+
+func checkRegistryCredentials() Check {
+	check := Check{Name: "Registry credentials"}
+
+	var missing []string
+	for _, env := range []string{image.AccessKeyIdEnv, image.SecretKeyEnv} {
+		if os.Getenv(env) == "" {
+			missing = append(missing, env)
+		}
+	}
+
+	if len(missing) > 0 {
+		check.Status, check.Message = Fail, fmt.Sprintf("environment variables are not set: %s", strings.Join(missing, ", "))
+		return check
+	}
+	check.Status, check.Message = Pass, "environment variables are set"
+	return check
+}
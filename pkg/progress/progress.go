@@ -0,0 +1,254 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	PhaseDownload   string = "download"
+	PhaseConversion string = "conversion"
+	PhasePush       string = "push"
+)
+
+var (
+	mutex      sync.Mutex
+	interval   = 30 * time.Second
+	jsonOutput *json.Encoder
+)
+
+// SetInterval sets the interval of the progress reports. Zero disables the periodic
+// reports, leaving the final one of every phase.
+func SetInterval(d time.Duration) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	interval = d
+}
+
+// SetJSONOutput makes every progress report also be written as a JSON Event line to w.
+func SetJSONOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	jsonOutput = json.NewEncoder(w)
+}
+
+// Event is a progress report in the JSON stream. Unknown values are omitted.
+type Event struct {
+	Time           time.Time `json:"time"`
+	Phase          string    `json:"phase"`
+	Name           string    `json:"name"`
+	BytesDone      int64     `json:"bytesDone,omitempty"`
+	BytesTotal     int64     `json:"bytesTotal,omitempty"`
+	Percent        float64   `json:"percent,omitempty"`
+	BytesPerSecond float64   `json:"bytesPerSecond,omitempty"`
+	ETASeconds     float64   `json:"etaSeconds,omitempty"`
+	ElapsedSeconds float64   `json:"elapsedSeconds"`
+	Final          bool      `json:"final,omitempty"`
+}
+
+// Reporter reports the progress of a phase, e.g. the download of a disk, periodically
+// until it's stopped. The total is zero while unknown. Without the number of bytes,
+// e.g. for nbdkit, the progress can be set as percentage.
+type Reporter struct {
+	phase string
+	name  string
+	start time.Time
+
+	done    atomic.Int64
+	total   atomic.Int64
+	percent atomic.Uint64
+
+	// Bytes and percentage at the last report, to compute the throughput and ETA.
+	mutex       sync.Mutex
+	startDone   int64
+	lastTime    time.Time
+	lastDone    int64
+	lastPercent float64
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// Start starts reporting the progress of the phase of name, e.g. a volume.
+func Start(phase, name string, total int64) *Reporter {
+	r := &Reporter{
+		phase:   phase,
+		name:    name,
+		start:   time.Now(),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	r.total.Store(total)
+	r.lastTime = r.start
+
+	mutex.Lock()
+	reportInterval := interval
+	mutex.Unlock()
+
+	if reportInterval <= 0 {
+		close(r.stopped)
+		return r
+	}
+
+	go func() {
+		defer close(r.stopped)
+
+		ticker := time.NewTicker(reportInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				r.report(false)
+			}
+		}
+	}()
+	return r
+}
+
+// Resume sets the bytes done before the phase started, e.g. by an interrupted download,
+// which don't count for the throughput. The total must be set before.
+func (r *Reporter) Resume(n int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.done.Store(n)
+	r.startDone, r.lastDone = n, n
+	if total := r.total.Load(); total > 0 {
+		r.lastPercent = float64(n) / float64(total) * 100
+	}
+}
+
+func (r *Reporter) Add(n int64) {
+	r.done.Add(n)
+}
+
+func (r *Reporter) Set(n int64) {
+	r.done.Store(n)
+}
+
+func (r *Reporter) SetTotal(total int64) {
+	r.total.Store(total)
+}
+
+// SetPercent sets the progress as percentage, converted to bytes when the total is known.
+func (r *Reporter) SetPercent(percent float64) {
+	if total := r.total.Load(); total > 0 {
+		r.done.Store(int64(percent / 100 * float64(total)))
+		return
+	}
+	r.percent.Store(math.Float64bits(percent))
+}
+
+// Stop stops the periodic reports, and reports the final progress with the average
+// throughput of the phase.
+func (r *Reporter) Stop() {
+	select {
+	case <-r.stop:
+		return
+	default:
+		close(r.stop)
+	}
+	<-r.stopped
+
+	r.report(true)
+}
+
+func (r *Reporter) report(final bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	done, total := r.done.Load(), r.total.Load()
+	percent := math.Float64frombits(r.percent.Load())
+	if total > 0 {
+		percent = float64(done) / float64(total) * 100
+	}
+
+	event := Event{
+		Time:           now,
+		Phase:          r.phase,
+		Name:           r.name,
+		BytesDone:      done,
+		BytesTotal:     total,
+		Percent:        math.Round(percent*10) / 10,
+		ElapsedSeconds: math.Round(now.Sub(r.start).Seconds()),
+		Final:          final,
+	}
+
+	// The final report has the average throughput, the others the throughput since
+	// the last report.
+	since, sinceDone, sincePercent := r.lastTime, r.lastDone, r.lastPercent
+	if final {
+		since, sinceDone, sincePercent = r.start, r.startDone, 0
+	}
+
+	if elapsed := now.Sub(since).Seconds(); elapsed > 0 {
+		event.BytesPerSecond = math.Round(float64(done-sinceDone) / elapsed)
+
+		if rate := (percent - sincePercent) / elapsed; !final && rate > 0 {
+			event.ETASeconds = math.Round((100 - percent) / rate)
+		}
+	}
+
+	r.lastTime, r.lastDone, r.lastPercent = now, done, percent
+
+	log.Printf("%s of '%s': %s", strings.ToUpper(r.phase[:1])+r.phase[1:], r.name, formatEvent(event))
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if jsonOutput != nil {
+		if err := jsonOutput.Encode(event); err != nil {
+			log.Printf("Failed to write progress: %v", err)
+		}
+	}
+}
+
+// formatEvent formats the event for the log, e.g. "1.2 GiB of 30.0 GiB (4.0%),
+// 85.3 MiB/s, ETA 5m50s".
+func formatEvent(event Event) string {
+	var parts []string
+
+	switch {
+	case event.BytesTotal > 0:
+		parts = append(parts, fmt.Sprintf("%s of %s (%.1f%%)", formatBytes(event.BytesDone), formatBytes(event.BytesTotal), event.Percent))
+	case event.BytesDone > 0:
+		parts = append(parts, formatBytes(event.BytesDone))
+	default:
+		parts = append(parts, fmt.Sprintf("%.1f%%", event.Percent))
+	}
+
+	if event.BytesPerSecond > 0 {
+		parts = append(parts, fmt.Sprintf("%s/s", formatBytes(int64(event.BytesPerSecond))))
+	}
+
+	if event.Final {
+		parts = append(parts, fmt.Sprintf("in %s", time.Duration(event.ElapsedSeconds)*time.Second))
+	} else if event.ETASeconds > 0 {
+		parts = append(parts, fmt.Sprintf("ETA %s", time.Duration(event.ETASeconds)*time.Second))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value, exponent := float64(n)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
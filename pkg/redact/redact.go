@@ -0,0 +1,81 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+)
+
+const mask string = "[REDACTED]"
+
+var (
+	mutex   sync.RWMutex
+	secrets []string
+)
+
+// Add registers the secret, so it's masked in every string passed to String, and in
+// everything written to the writers returned by NewWriter, e.g. the log.
+func Add(secret string) {
+	if secret == "" {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	secrets = append(secrets, secret)
+}
+
+// String masks the registered secrets in the string.
+func String(s string) string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, mask)
+	}
+	return s
+}
+
+// Writer masks the registered secrets in everything written to it. Output is written
+// line by line, so secrets split across writes are masked too, and Flush writes the rest.
+type Writer struct {
+	mutex  sync.Mutex
+	writer io.Writer
+	buffer bytes.Buffer
+}
+
+func NewWriter(writer io.Writer) *Writer {
+	return &Writer{writer: writer}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buffer.Write(p)
+	for {
+		index := bytes.IndexByte(w.buffer.Bytes(), '\n')
+		if index == -1 {
+			return len(p), nil
+		}
+
+		line := w.buffer.Next(index + 1)
+		if _, err := io.WriteString(w.writer, String(string(line))); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (w *Writer) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.buffer.Len() == 0 {
+		return nil
+	}
+
+	_, err := io.WriteString(w.writer, String(w.buffer.String()))
+	w.buffer.Reset()
+	return err
+}
@@ -0,0 +1,165 @@
+package runstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	kvcorev1 "kubevirt.io/api/core/v1"
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+// The original run state is stored on the VM itself, so it survives a crashed run
+// and can be restored by the next one.
+const originalRunStateAnnotation string = "kubevirt-disk-uploader/original-run-state"
+
+type runState struct {
+	Running     *bool                               `json:"running,omitempty"`
+	RunStrategy *kvcorev1.VirtualMachineRunStrategy `json:"runStrategy,omitempty"`
+	// Started is set when the VM with the Manual run strategy was running.
+	Started bool `json:"started,omitempty"`
+}
+
+// StopVirtualMachine records the run state of the VM in an annotation and stops it in
+// the same update. The state recorded by a previous run, if any, is kept.
+func StopVirtualMachine(client kubecli.KubevirtClient, namespace, name string) error {
+	vm, err := client.VirtualMachine(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	annotation, ok := vm.Annotations[originalRunStateAnnotation]
+	if !ok {
+		state, err := getRunState(client, vm)
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		annotation = string(data)
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": vm.ResourceVersion,
+			"annotations": map[string]interface{}{
+				originalRunStateAnnotation: annotation,
+			},
+		},
+		"spec": map[string]interface{}{
+			"running":     nil,
+			"runStrategy": kvcorev1.RunStrategyHalted,
+		},
+	}
+	return patchVirtualMachine(client, namespace, name, patch)
+}
+
+func WaitUntilVirtualMachineStopped(ctx context.Context, client kubecli.KubevirtClient, namespace, name string) error {
+	pollInterval := 5 * time.Second
+	pollTimeout := 600 * time.Second
+	poller := func(ctx context.Context) (bool, error) {
+		_, err := client.VirtualMachineInstance(namespace).Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller)
+}
+
+// RestoreVirtualMachine restores the run state recorded by StopVirtualMachine and
+// removes the annotation. VMs without the annotation are left untouched.
+func RestoreVirtualMachine(client kubecli.KubevirtClient, namespace, name string) error {
+	vm, err := client.VirtualMachine(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+
+	annotation, ok := vm.Annotations[originalRunStateAnnotation]
+	if !ok {
+		return nil
+	}
+
+	state := &runState{}
+	if err := json.Unmarshal([]byte(annotation), state); err != nil {
+		return fmt.Errorf("failed to parse annotation '%s': %w", originalRunStateAnnotation, err)
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]interface{}{
+				originalRunStateAnnotation: nil,
+			},
+		},
+		"spec": map[string]interface{}{
+			"running":     state.Running,
+			"runStrategy": state.RunStrategy,
+		},
+	}
+	if err := patchVirtualMachine(client, namespace, name, patch); err != nil {
+		return err
+	}
+
+	if state.Started {
+		return client.VirtualMachine(namespace).Start(context.Background(), name, &kvcorev1.StartOptions{})
+	}
+	return nil
+}
+
+// ListStoppedVirtualMachines lists the names of the VMs with the run state recorded by
+// StopVirtualMachine, including the VMs left stopped by crashed runs.
+func ListStoppedVirtualMachines(client kubecli.KubevirtClient, namespace string) ([]string, error) {
+	vms, err := client.VirtualMachine(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, vm := range vms.Items {
+		if _, ok := vm.Annotations[originalRunStateAnnotation]; ok {
+			names = append(names, vm.Name)
+		}
+	}
+	return names, nil
+}
+
+func getRunState(client kubecli.KubevirtClient, vm *kvcorev1.VirtualMachine) (*runState, error) {
+	state := &runState{
+		Running:     vm.Spec.Running,
+		RunStrategy: vm.Spec.RunStrategy,
+	}
+
+	runStrategy, err := vm.RunStrategy()
+	if err != nil {
+		return nil, err
+	}
+
+	if runStrategy == kvcorev1.RunStrategyManual {
+		_, err := client.VirtualMachineInstance(vm.Namespace).Get(context.Background(), vm.Name, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		state.Started = err == nil
+	}
+	return state, nil
+}
+
+func patchVirtualMachine(client kubecli.KubevirtClient, namespace, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.VirtualMachine(namespace).Patch(context.Background(), name, types.MergePatchType, data, metav1.PatchOptions{})
+	return err
+}
@@ -9,12 +9,13 @@ import (
 	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	kubecli "kubevirt.io/client-go/kubecli"
 )
 
-func CreateVirtualMachineExportSecret(client kubecli.KubevirtClient, namespace, name string) error {
+func CreateVirtualMachineExportSecret(client kubecli.KubevirtClient, namespace, name string, owner *ownerreference.Owner) error {
 	length := 20
 	token, err := GenerateSecureRandomString(length)
 	if err != nil {
@@ -31,9 +32,7 @@ func CreateVirtualMachineExportSecret(client kubecli.KubevirtClient, namespace,
 		},
 	}
 
-	if err := ownerreference.SetPodOwnerReference(client, v1Secret); err != nil {
-		return err
-	}
+	ownerreference.SetOwnerReference(v1Secret, owner)
 
 	_, err = client.CoreV1().Secrets(namespace).Create(context.Background(), v1Secret, metav1.CreateOptions{})
 	return err
@@ -52,6 +51,25 @@ func GetTokenFromVirtualMachineExportSecret(client kubecli.KubevirtClient, names
 	return string(data), nil
 }
 
+func VirtualMachineExportSecretExists(client kubecli.KubevirtClient, namespace, name string) (bool, error) {
+	_, err := client.CoreV1().Secrets(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func DeleteVirtualMachineExportSecret(client kubecli.KubevirtClient, namespace, name string) error {
+	err := client.CoreV1().Secrets(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
 func GenerateSecureRandomString(n int) (string, error) {
 	// Alphanums is the list of alphanumeric characters used to create a securely generated random string
 	alphanums := "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
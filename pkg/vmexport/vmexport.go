@@ -3,31 +3,280 @@ package vmexport
 import (
 	"context"
 	"fmt"
+	"log"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/codingben/kubevirt-disk-uploader/pkg/cdi"
 	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/volumesnapshot"
 
+	k8ssnapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
 
 	kvcorev1 "kubevirt.io/api/core/v1"
 	v1beta1 "kubevirt.io/api/export/v1beta1"
 	snapshotv1 "kubevirt.io/api/snapshot/v1beta1"
 	kubecli "kubevirt.io/client-go/kubecli"
+	cdiv1beta1 "kubevirt.io/containerized-data-importer-api/pkg/apis/core/v1beta1"
+)
+
+const (
+	readyTimeout       = 3600 * time.Second
+	readyCheckInterval = 10 * time.Second
+	// Skipped exports become ready once the source is no longer in use, so give it a moment.
+	skippedTimeout = 2 * time.Minute
+	// The Service of the export server is named virt-export-<name>, and must be a DNS label.
+	maxExportNamePrefixLength = 40
 )
 
 const (
 	sourceVM         string = "vm"
 	sourceVMSnapshot string = "vmsnapshot"
 	sourcePVC        string = "pvc"
+	sourceDataVolume string = "datavolume"
+	sourceDataSource string = "datasource"
+	// VolumeSnapshots are exported through a temporary PVC restored from them.
+	sourceVolumeSnapshot string = "volumesnapshot"
+)
+
+const (
+	LinkInternal string = "internal"
+	LinkExternal string = "external"
+	LinkAuto     string = "auto"
 )
 
 var (
 	exportSources = map[string]struct{}{sourceVM: {}, sourceVMSnapshot: {}, sourcePVC: {}}
 )
 
-func CreateVirtualMachineExport(client kubecli.KubevirtClient, exportSourceKind, exportSourceNamespace, exportSourceName string) error {
+// ResolveExportSource resolves CDI export sources (DataVolume, DataSource) to the
+// PVC or VolumeSnapshot backing them, other export sources are returned as they are.
+func ResolveExportSource(client kubecli.KubevirtClient, exportSourceKind, exportSourceNamespace, exportSourceName string) (string, string, string, error) {
+	switch exportSourceKind {
+	case sourceDataVolume:
+		claimName, err := cdi.GetDataVolumeClaimName(client, exportSourceNamespace, exportSourceName)
+		if err != nil {
+			return "", "", "", err
+		}
+		return sourcePVC, exportSourceNamespace, claimName, nil
+	case sourceDataSource:
+		source, err := cdi.GetDataSourceSource(client, exportSourceNamespace, exportSourceName)
+		if err != nil {
+			return "", "", "", err
+		}
+
+		if source.Snapshot != nil {
+			namespace := source.Snapshot.Namespace
+			if namespace == "" {
+				namespace = exportSourceNamespace
+			}
+			return sourceVolumeSnapshot, namespace, source.Snapshot.Name, nil
+		}
+
+		namespace := source.PVC.Namespace
+		if namespace == "" {
+			namespace = exportSourceNamespace
+		}
+		return sourcePVC, namespace, source.PVC.Name, nil
+	case sourceVolumeSnapshot:
+		return exportSourceKind, exportSourceNamespace, exportSourceName, nil
+	default:
+		if !isValidExportSource(exportSourceKind) {
+			return "", "", "", fmt.Errorf("invalid export-source-kind: %s, must be one of vm, vmsnapshot, pvc, datavolume, datasource, volumesnapshot", exportSourceKind)
+		}
+		return exportSourceKind, exportSourceNamespace, exportSourceName, nil
+	}
+}
+
+// GetExportSourceResource returns the API group and resource of the export source kind,
+// e.g. to check the permissions needed to read it.
+func GetExportSourceResource(exportSourceKind string) (string, string, error) {
+	switch exportSourceKind {
+	case sourceVM:
+		return kvcorev1.SchemeGroupVersion.Group, "virtualmachines", nil
+	case sourceVMSnapshot:
+		return snapshotv1.SchemeGroupVersion.Group, "virtualmachinesnapshots", nil
+	case sourcePVC:
+		return corev1.SchemeGroupVersion.Group, "persistentvolumeclaims", nil
+	case sourceDataVolume:
+		return cdiv1beta1.SchemeGroupVersion.Group, "datavolumes", nil
+	case sourceDataSource:
+		return cdiv1beta1.SchemeGroupVersion.Group, "datasources", nil
+	case sourceVolumeSnapshot:
+		return k8ssnapshotv1.SchemeGroupVersion.Group, "volumesnapshots", nil
+	default:
+		return "", "", fmt.Errorf("invalid export-source-kind: %s", exportSourceKind)
+	}
+}
+
+// CheckExportSourceExists checks that the resolved export source exists.
+func CheckExportSourceExists(client kubecli.KubevirtClient, exportSourceKind, exportSourceNamespace, exportSourceName string) error {
+	var err error
+	switch exportSourceKind {
+	case sourceVM:
+		_, err = client.VirtualMachine(exportSourceNamespace).Get(context.Background(), exportSourceName, metav1.GetOptions{})
+	case sourceVMSnapshot:
+		_, err = client.VirtualMachineSnapshot(exportSourceNamespace).Get(context.Background(), exportSourceName, metav1.GetOptions{})
+	case sourcePVC:
+		_, err = client.CoreV1().PersistentVolumeClaims(exportSourceNamespace).Get(context.Background(), exportSourceName, metav1.GetOptions{})
+	case sourceVolumeSnapshot:
+		_, err = client.KubernetesSnapshotClient().SnapshotV1().VolumeSnapshots(exportSourceNamespace).Get(context.Background(), exportSourceName, metav1.GetOptions{})
+	default:
+		err = fmt.Errorf("invalid export-source-kind: %s", exportSourceKind)
+	}
+	return err
+}
+
+// ExportSource is an export source found by ListExportSources.
+type ExportSource struct {
+	Namespace string
+	Name      string
+}
+
+// ListExportSources lists the export sources of the kind matching the label selector,
+// in all namespaces if the namespace is empty.
+func ListExportSources(client kubecli.KubevirtClient, exportSourceKind, namespace, selector string) ([]ExportSource, error) {
+	listOptions := metav1.ListOptions{LabelSelector: selector}
+
+	var objects []metav1.ObjectMeta
+	switch exportSourceKind {
+	case sourceVM:
+		list, err := client.VirtualMachine(namespace).List(context.Background(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case sourceVMSnapshot:
+		list, err := client.VirtualMachineSnapshot(namespace).List(context.Background(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case sourcePVC:
+		list, err := client.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case sourceDataVolume:
+		list, err := client.CdiClient().CdiV1beta1().DataVolumes(namespace).List(context.Background(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case sourceDataSource:
+		list, err := client.CdiClient().CdiV1beta1().DataSources(namespace).List(context.Background(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	case sourceVolumeSnapshot:
+		list, err := client.KubernetesSnapshotClient().SnapshotV1().VolumeSnapshots(namespace).List(context.Background(), listOptions)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range list.Items {
+			objects = append(objects, item.ObjectMeta)
+		}
+	default:
+		return nil, fmt.Errorf("invalid export-source-kind: %s", exportSourceKind)
+	}
+
+	var exportSources []ExportSource
+	for _, object := range objects {
+		exportSources = append(exportSources, ExportSource{Namespace: object.Namespace, Name: object.Name})
+	}
+	return exportSources, nil
+}
+
+func IsVolumeSnapshotSource(exportSourceKind string) bool {
+	return exportSourceKind == sourceVolumeSnapshot
+}
+
+// RestoreVolumeSnapshotSource restores the VolumeSnapshot into a temporary PVC,
+// which is exported instead of the snapshot itself.
+func RestoreVolumeSnapshotSource(client kubecli.KubevirtClient, exportSourceNamespace, exportSourceName string, owner *ownerreference.Owner) (string, string, error) {
+	pvcName, err := volumesnapshot.CreatePersistentVolumeClaim(client, exportSourceNamespace, exportSourceName, owner)
+	if err != nil {
+		return "", "", err
+	}
+	return sourcePVC, pvcName, nil
+}
+
+// GetRestoredVolumeSnapshotSource returns the export source of a PVC restored from a
+// VolumeSnapshot by a previous run, which is exported again.
+func GetRestoredVolumeSnapshotSource(pvcName string) (string, string) {
+	return sourcePVC, pvcName
+}
+
+func IsVirtualMachineSource(exportSourceKind string) bool {
+	return exportSourceKind == sourceVM
+}
+
+// GetVirtualMachineSource returns the export source of a VM, e.g. to lock it.
+func GetVirtualMachineSource(vmName string) (string, string) {
+	return sourceVM, vmName
+}
+
+func IsVirtualMachineSnapshotSource(exportSourceKind string) bool {
+	return exportSourceKind == sourceVMSnapshot
+}
+
+// GetVirtualMachineSnapshotSource returns the export source of a VirtualMachineSnapshot
+// taken by the uploader, which is exported instead of the VM itself.
+func GetVirtualMachineSnapshotSource(vmSnapshotName string) (string, string) {
+	return sourceVMSnapshot, vmSnapshotName
+}
+
+// HasDefaultVolumeName reports whether the export source has a single volume, whose name
+// is set by GetDefaultVolumeName once the source is resolved.
+func HasDefaultVolumeName(exportSourceKind string) bool {
+	switch exportSourceKind {
+	case sourcePVC, sourceDataVolume, sourceDataSource, sourceVolumeSnapshot:
+		return true
+	}
+	return false
+}
+
+// GetDefaultVolumeName returns the name of the exported volume when it can be
+// derived from the export source, which is the case for PVCs only.
+func GetDefaultVolumeName(exportSourceKind, exportSourceName string) string {
+	if exportSourceKind == sourcePVC {
+		return exportSourceName
+	}
+	return ""
+}
+
+// GetExportName returns the name of the VirtualMachineExport and its token Secret, which
+// is unique to the run, so concurrent runs don't collide. The source name is shortened,
+// as KubeVirt names the Service of the export server after the export.
+func GetExportName(exportSourceName, runID string) string {
+	if len(exportSourceName) > maxExportNamePrefixLength {
+		exportSourceName = strings.TrimRight(exportSourceName[:maxExportNamePrefixLength], "-.")
+	}
+	return fmt.Sprintf("%s-%s", exportSourceName, runID)
+}
+
+// CreateVirtualMachineExport creates the VirtualMachineExport of the source, using the
+// token Secret of the same name.
+func CreateVirtualMachineExport(client kubecli.KubevirtClient, exportSourceKind, exportSourceNamespace, exportSourceName, name string, ttlDuration time.Duration, owner *ownerreference.Owner) error {
 	if !isValidExportSource(exportSourceKind) {
 		return fmt.Errorf("invalid export-source-kind: %s, must be one of vm, vmsnapshot, pvc", exportSourceKind)
 	}
@@ -39,63 +288,313 @@ func CreateVirtualMachineExport(client kubecli.KubevirtClient, exportSourceKind,
 
 	v1VmExport := &v1beta1.VirtualMachineExport{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      exportSourceName,
+			Name:      name,
 			Namespace: exportSourceNamespace,
 		},
 		Spec: v1beta1.VirtualMachineExportSpec{
-			TokenSecretRef: &exportSourceName,
+			TokenSecretRef: &name,
 			Source:         source,
 		},
 	}
 
-	if err := ownerreference.SetPodOwnerReference(client, v1VmExport); err != nil {
-		return err
+	if ttlDuration > 0 {
+		v1VmExport.Spec.TTLDuration = &metav1.Duration{Duration: ttlDuration}
 	}
 
+	ownerreference.SetOwnerReference(v1VmExport, owner)
+
 	_, err = client.VirtualMachineExport(exportSourceNamespace).Create(context.Background(), v1VmExport, metav1.CreateOptions{})
 	return err
 }
 
-func WaitUntilVirtualMachineExportReady(client kubecli.KubevirtClient, namespace, name string) error {
-	pollInterval := 15 * time.Second
-	pollTimeout := 3600 * time.Second
+// ListVirtualMachineExports lists the VirtualMachineExports of the source created by the
+// uploader, e.g. the ones left behind by a crashed run.
+func ListVirtualMachineExports(client kubecli.KubevirtClient, exportSourceKind, exportSourceNamespace, exportSourceName string) ([]v1beta1.VirtualMachineExport, error) {
+	source, err := getExportSource(exportSourceKind, exportSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	selector := fmt.Sprintf("%s=%s", ownerreference.ManagedByLabel, ownerreference.ManagedByValue)
+	vmExports, err := client.VirtualMachineExport(exportSourceNamespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	var sourceExports []v1beta1.VirtualMachineExport
+	for _, vmExport := range vmExports.Items {
+		exportSource := vmExport.Spec.Source
+		if exportSource.Kind == source.Kind &&
+			exportSource.Name == source.Name &&
+			exportSource.APIGroup != nil && *exportSource.APIGroup == *source.APIGroup {
+			sourceExports = append(sourceExports, vmExport)
+		}
+	}
+	return sourceExports, nil
+}
+
+// DeleteVirtualMachineExport deletes the VirtualMachineExport without waiting until it's gone.
+func DeleteVirtualMachineExport(client kubecli.KubevirtClient, namespace, name string) error {
+	err := client.VirtualMachineExport(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// WaitUntilVirtualMachineExportDeleted waits until the deleted VirtualMachineExport is
+// gone, e.g. before a new export of the same source is created.
+func WaitUntilVirtualMachineExportDeleted(ctx context.Context, client kubecli.KubevirtClient, namespace, name string) error {
+	pollInterval := 2 * time.Second
+	pollTimeout := 120 * time.Second
 	poller := func(ctx context.Context) (bool, error) {
+		_, err := client.VirtualMachineExport(namespace).Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+
+	return wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller)
+}
+
+// WaitUntilVirtualMachineExportReady watches the VirtualMachineExport until it's ready.
+// It fails fast when the export is terminated or stays skipped, e.g. because the VM is running.
+func WaitUntilVirtualMachineExportReady(ctx context.Context, client kubecli.KubevirtClient, namespace, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, readyTimeout)
+	defer cancel()
+
+	state := &readinessState{}
+	for {
 		vmExport, err := client.VirtualMachineExport(namespace).Get(ctx, name, metav1.GetOptions{})
 		if err != nil {
-			return false, err
+			return err
 		}
 
-		if vmExport.Status != nil && vmExport.Status.Phase == v1beta1.Ready {
-			return true, nil
+		ready, err := state.check(vmExport)
+		if ready || err != nil {
+			return err
+		}
+
+		watcher, err := client.VirtualMachineExport(namespace).Watch(ctx, metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", name).String(),
+			ResourceVersion: vmExport.ResourceVersion,
+		})
+		if err != nil {
+			return err
+		}
+
+		ready, err = state.watch(ctx, watcher, vmExport)
+		watcher.Stop()
+		if ready || err != nil {
+			return err
 		}
+		// The watch was closed by the server, so start over from the latest version.
+	}
+}
+
+type readinessState struct {
+	lastMessage  string
+	skippedSince time.Time
+}
+
+func (s *readinessState) watch(ctx context.Context, watcher watch.Interface, vmExport *v1beta1.VirtualMachineExport) (bool, error) {
+	ticker := time.NewTicker(readyCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf("VirtualMachineExport '%s/%s' is not ready: %w", vmExport.Namespace, vmExport.Name, ctx.Err())
+		case <-ticker.C:
+			// Re-check the last known status, so a skipped export fails without further events.
+			if ready, err := s.check(vmExport); ready || err != nil {
+				return ready, err
+			}
+		case event, ok := <-watcher.ResultChan():
+			if !ok || event.Type == watch.Error {
+				return false, nil
+			}
+
+			if event.Type == watch.Deleted {
+				return false, fmt.Errorf("VirtualMachineExport '%s/%s' was deleted while waiting for it to be ready", vmExport.Namespace, vmExport.Name)
+			}
+
+			if object, ok := event.Object.(*v1beta1.VirtualMachineExport); ok {
+				vmExport = object
+			}
+
+			if ready, err := s.check(vmExport); ready || err != nil {
+				return ready, err
+			}
+		}
+	}
+}
+
+func (s *readinessState) check(vmExport *v1beta1.VirtualMachineExport) (bool, error) {
+	if vmExport.Status == nil {
 		return false, nil
 	}
 
-	return wait.PollUntilContextTimeout(context.Background(), pollInterval, pollTimeout, true, poller)
+	message := getNotReadyMessage(vmExport.Status)
+	if message != "" && message != s.lastMessage {
+		log.Printf("VirtualMachineExport '%s/%s' is not ready yet: %s", vmExport.Namespace, vmExport.Name, message)
+	}
+	s.lastMessage = message
+
+	switch vmExport.Status.Phase {
+	case v1beta1.Ready:
+		return true, nil
+	case v1beta1.Terminated:
+		return false, fmt.Errorf("VirtualMachineExport '%s/%s' is terminated: %s", vmExport.Namespace, vmExport.Name, message)
+	case v1beta1.Skipped:
+		if s.skippedSince.IsZero() {
+			s.skippedSince = time.Now()
+		}
+
+		if time.Since(s.skippedSince) >= skippedTimeout {
+			return false, fmt.Errorf("VirtualMachineExport '%s/%s' is skipped: %s", vmExport.Namespace, vmExport.Name, message)
+		}
+	default:
+		s.skippedSince = time.Time{}
+	}
+	return false, nil
 }
 
-func GetRawDiskUrlFromVolumes(client kubecli.KubevirtClient, namespace, name, volumeName string) (string, error) {
+func getNotReadyMessage(status *v1beta1.VirtualMachineExportStatus) string {
+	var messages []string
+	for _, condition := range status.Conditions {
+		if condition.Status == corev1.ConditionTrue {
+			continue
+		}
+
+		switch {
+		case condition.Message != "" && condition.Reason != "":
+			messages = append(messages, fmt.Sprintf("%s (%s)", condition.Message, condition.Reason))
+		case condition.Message != "":
+			messages = append(messages, condition.Message)
+		case condition.Reason != "":
+			messages = append(messages, condition.Reason)
+		}
+	}
+
+	if len(messages) == 0 {
+		return fmt.Sprintf("phase is %s", status.Phase)
+	}
+	return strings.Join(messages, "; ")
+}
+
+type RawDiskUrl struct {
+	VolumeName string
+	Url        string
+	// GzipUrl is the URL of the gzipped raw disk, if the export server offers it.
+	GzipUrl string
+}
+
+func GetRawDiskUrlFromVolumes(client kubecli.KubevirtClient, namespace, name, volumeName, link string) (RawDiskUrl, error) {
+	rawDiskUrls, err := GetRawDiskUrlsFromVolumes(client, namespace, name, link)
+	if err != nil {
+		return RawDiskUrl{}, err
+	}
+
+	for _, rawDiskUrl := range rawDiskUrls {
+		if volumeName == rawDiskUrl.VolumeName {
+			return rawDiskUrl, nil
+		}
+	}
+	return RawDiskUrl{}, fmt.Errorf("volume %s is not found in VirtualMachineExport %s volumes", volumeName, link)
+}
+
+func GetRawDiskUrlsFromVolumes(client kubecli.KubevirtClient, namespace, name, link string) ([]RawDiskUrl, error) {
 	vmExport, err := client.VirtualMachineExport(namespace).Get(context.Background(), name, metav1.GetOptions{})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	if vmExport.Status.Links == nil && vmExport.Status.Links.Internal == nil {
-		return "", fmt.Errorf("no links found in VirtualMachineExport status")
+	exportLink, err := GetExportLink(vmExport, link)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, volume := range vmExport.Status.Links.Internal.Volumes {
-		if volumeName != volume.Name {
-			continue
+	var rawDiskUrls []RawDiskUrl
+	for _, volume := range exportLink.Volumes {
+		volumeName := volume.Name
+		if vmExport.Spec.Source.Kind == "VirtualMachineSnapshot" {
+			// PVCs restored from a VirtualMachineSnapshot are prefixed with the export name.
+			volumeName = strings.TrimPrefix(volumeName, fmt.Sprintf("%s-", name))
 		}
 
+		rawDiskUrl := RawDiskUrl{VolumeName: volumeName}
 		for _, format := range volume.Formats {
-			if format.Format == v1beta1.KubeVirtRaw {
-				return format.Url, nil
+			switch format.Format {
+			case v1beta1.KubeVirtRaw:
+				rawDiskUrl.Url = format.Url
+			case v1beta1.KubeVirtGz:
+				rawDiskUrl.GzipUrl = format.Url
 			}
 		}
+
+		if rawDiskUrl.Url != "" {
+			rawDiskUrls = append(rawDiskUrls, rawDiskUrl)
+		}
+	}
+
+	if len(rawDiskUrls) == 0 {
+		return nil, fmt.Errorf("no raw disk volumes found in VirtualMachineExport %s volumes", link)
+	}
+	return rawDiskUrls, nil
+}
+
+func GetManifestUrl(client kubecli.KubevirtClient, namespace, name, link string) (string, error) {
+	vmExport, err := client.VirtualMachineExport(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	exportLink, err := GetExportLink(vmExport, link)
+	if err != nil {
+		return "", err
+	}
+
+	for _, manifest := range exportLink.Manifests {
+		if manifest.Type == v1beta1.AllManifests {
+			return manifest.Url, nil
+		}
+	}
+	return "", fmt.Errorf("no manifests found in VirtualMachineExport %s links", link)
+}
+
+// ResolveLink validates the link and resolves 'auto' to the internal link when
+// running inside the cluster, and to the external link otherwise.
+func ResolveLink(link string) (string, error) {
+	switch link {
+	case LinkInternal, LinkExternal:
+		return link, nil
+	case LinkAuto:
+		if _, isSet := os.LookupEnv("KUBERNETES_SERVICE_HOST"); isSet {
+			return LinkInternal, nil
+		}
+		return LinkExternal, nil
+	default:
+		return "", fmt.Errorf("invalid link: %s, must be one of internal, external, auto", link)
+	}
+}
+
+// GetExportLink returns the internal or external link of the VirtualMachineExport status.
+func GetExportLink(vmExport *v1beta1.VirtualMachineExport, link string) (*v1beta1.VirtualMachineExportLink, error) {
+	if vmExport.Status == nil || vmExport.Status.Links == nil {
+		return nil, fmt.Errorf("no links found in VirtualMachineExport status")
+	}
+
+	exportLink := vmExport.Status.Links.Internal
+	if link == LinkExternal {
+		exportLink = vmExport.Status.Links.External
+	}
+
+	if exportLink == nil {
+		return nil, fmt.Errorf("no %s links found in VirtualMachineExport status", link)
 	}
-	return "", fmt.Errorf("volume %s is not found in VirtualMachineExport internal volumes", volumeName)
+	return exportLink, nil
 }
 
 func getExportSource(exportSourceKind, exportSourceName string) (corev1.TypedLocalObjectReference, error) {
@@ -0,0 +1,96 @@
+package vmsnapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	kvcorev1 "kubevirt.io/api/core/v1"
+	snapshotv1 "kubevirt.io/api/snapshot/v1beta1"
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+// CreateVirtualMachineSnapshot creates a VirtualMachineSnapshot of the VM and returns its
+// name. KubeVirt freezes the guest filesystems when the guest agent is available.
+func CreateVirtualMachineSnapshot(client kubecli.KubevirtClient, namespace, vmName string, owner *ownerreference.Owner) (string, error) {
+	v1VmSnapshot := &snapshotv1.VirtualMachineSnapshot{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s-snapshot-", vmName),
+			Namespace:    namespace,
+		},
+		Spec: snapshotv1.VirtualMachineSnapshotSpec{
+			Source: corev1.TypedLocalObjectReference{
+				APIGroup: &kvcorev1.SchemeGroupVersion.Group,
+				Kind:     "VirtualMachine",
+				Name:     vmName,
+			},
+		},
+	}
+
+	ownerreference.SetOwnerReference(v1VmSnapshot, owner)
+
+	vmSnapshot, err := client.VirtualMachineSnapshot(namespace).Create(context.Background(), v1VmSnapshot, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return vmSnapshot.Name, nil
+}
+
+func WaitUntilVirtualMachineSnapshotReady(ctx context.Context, client kubecli.KubevirtClient, namespace, name string) error {
+	pollInterval := 5 * time.Second
+	pollTimeout := 3600 * time.Second
+	poller := func(ctx context.Context) (bool, error) {
+		vmSnapshot, err := client.VirtualMachineSnapshot(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+
+		status := vmSnapshot.Status
+		if status == nil {
+			return false, nil
+		}
+
+		if status.Phase == snapshotv1.Failed {
+			message := "unknown error"
+			if status.Error != nil && status.Error.Message != nil {
+				message = *status.Error.Message
+			}
+			return false, fmt.Errorf("VirtualMachineSnapshot '%s/%s' failed: %s", namespace, name, message)
+		}
+
+		if status.ReadyToUse != nil && *status.ReadyToUse {
+			logIndications(vmSnapshot)
+			return true, nil
+		}
+		return false, nil
+	}
+
+	return wait.PollUntilContextTimeout(ctx, pollInterval, pollTimeout, true, poller)
+}
+
+func DeleteVirtualMachineSnapshot(client kubecli.KubevirtClient, namespace, name string) error {
+	err := client.VirtualMachineSnapshot(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func logIndications(vmSnapshot *snapshotv1.VirtualMachineSnapshot) {
+	for _, indication := range vmSnapshot.Status.Indications {
+		switch indication {
+		case snapshotv1.VMSnapshotGuestAgentIndication:
+			log.Println("VirtualMachineSnapshot was taken with guest filesystems frozen by the guest agent.")
+		case snapshotv1.VMSnapshotNoGuestAgentIndication:
+			log.Println("VirtualMachineSnapshot was taken without guest agent, the data is crash-consistent only.")
+		}
+	}
+}
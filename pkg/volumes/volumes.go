@@ -0,0 +1,181 @@
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/vmexport"
+	"github.com/codingben/kubevirt-disk-uploader/pkg/volumesnapshot"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+const (
+	contentTypeAnnotation string = "cdi.kubevirt.io/storage.contentType"
+	defaultContentType    string = "kubevirt"
+)
+
+// Volume is a volume exposed by the export. Name is the value of --volumename.
+type Volume struct {
+	Name        string
+	PvcName     string
+	Size        string
+	VolumeMode  string
+	ContentType string
+	DiskName    string
+}
+
+// ListVolumes lists the volumes the export of the source will expose, without creating
+// the export. VMs and VM snapshots are read from their spec.
+func ListVolumes(client kubecli.KubevirtClient, exportSourceKind, exportSourceNamespace, exportSourceName string) ([]Volume, error) {
+	kind, namespace, name, err := vmexport.ResolveExportSource(client, exportSourceKind, exportSourceNamespace, exportSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case vmexport.IsVirtualMachineSource(kind):
+		return listVirtualMachineVolumes(client, namespace, name)
+	case vmexport.IsVirtualMachineSnapshotSource(kind):
+		return listVirtualMachineSnapshotVolumes(client, namespace, name)
+	case vmexport.IsVolumeSnapshotSource(kind):
+		return listVolumeSnapshotVolumes(client, namespace, name)
+	default:
+		pvc, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return []Volume{newVolume(pvc.Name, &pvc.ObjectMeta, &pvc.Spec, pvc.Status.Capacity, "")}, nil
+	}
+}
+
+func PrintVolumes(w io.Writer, volumes []Volume) error {
+	writer := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "VOLUME\tPVC\tSIZE\tVOLUME MODE\tCONTENT TYPE\tDISK")
+	for _, volume := range volumes {
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			volume.Name, volume.PvcName, volume.Size, volume.VolumeMode, volume.ContentType, orNone(volume.DiskName))
+	}
+	return writer.Flush()
+}
+
+func listVirtualMachineVolumes(client kubecli.KubevirtClient, namespace, name string) ([]Volume, error) {
+	vm, err := client.VirtualMachine(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if vm.Spec.Template == nil {
+		return nil, nil
+	}
+
+	var volumes []Volume
+	for _, volume := range vm.Spec.Template.Spec.Volumes {
+		claimName := ""
+		switch {
+		case volume.DataVolume != nil:
+			claimName = volume.DataVolume.Name
+		case volume.PersistentVolumeClaim != nil:
+			claimName = volume.PersistentVolumeClaim.ClaimName
+		default:
+			// Only volumes backed by PVCs are exported.
+			continue
+		}
+
+		pvc, err := client.CoreV1().PersistentVolumeClaims(namespace).Get(context.Background(), claimName, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			volumes = append(volumes, Volume{Name: claimName, PvcName: claimName, DiskName: volume.Name})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		volumes = append(volumes, newVolume(claimName, &pvc.ObjectMeta, &pvc.Spec, pvc.Status.Capacity, volume.Name))
+	}
+	return volumes, nil
+}
+
+func listVirtualMachineSnapshotVolumes(client kubecli.KubevirtClient, namespace, name string) ([]Volume, error) {
+	vmSnapshot, err := client.VirtualMachineSnapshot(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if vmSnapshot.Status == nil || vmSnapshot.Status.VirtualMachineSnapshotContentName == nil {
+		return nil, fmt.Errorf("VirtualMachineSnapshot '%s/%s' has no content yet", namespace, name)
+	}
+
+	content, err := client.VirtualMachineSnapshotContent(namespace).Get(context.Background(), *vmSnapshot.Status.VirtualMachineSnapshotContentName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []Volume
+	for _, backup := range content.Spec.VolumeBackups {
+		pvc := backup.PersistentVolumeClaim
+		volumes = append(volumes, newVolume(pvc.Name, &pvc.ObjectMeta, &pvc.Spec, nil, backup.VolumeName))
+	}
+	return volumes, nil
+}
+
+func listVolumeSnapshotVolumes(client kubecli.KubevirtClient, namespace, name string) ([]Volume, error) {
+	snapshot, err := client.KubernetesSnapshotClient().SnapshotV1().VolumeSnapshots(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	volume := Volume{
+		// The volume is exported from a temporary PVC restored from the snapshot.
+		Name:        volumesnapshot.GetVolumeName(name),
+		PvcName:     "<none>",
+		ContentType: defaultContentType,
+	}
+
+	if snapshot.Spec.Source.PersistentVolumeClaimName != nil {
+		volume.PvcName = *snapshot.Spec.Source.PersistentVolumeClaimName
+	}
+
+	if snapshot.Status != nil && snapshot.Status.RestoreSize != nil {
+		volume.Size = snapshot.Status.RestoreSize.String()
+	}
+	return []Volume{volume}, nil
+}
+
+func newVolume(name string, meta *metav1.ObjectMeta, spec *corev1.PersistentVolumeClaimSpec, capacity corev1.ResourceList, diskName string) Volume {
+	volume := Volume{
+		Name:        name,
+		PvcName:     meta.Name,
+		VolumeMode:  string(corev1.PersistentVolumeFilesystem),
+		ContentType: defaultContentType,
+		DiskName:    diskName,
+	}
+
+	if size, ok := capacity[corev1.ResourceStorage]; ok {
+		volume.Size = size.String()
+	} else if size, ok := spec.Resources.Requests[corev1.ResourceStorage]; ok {
+		volume.Size = size.String()
+	}
+
+	if spec.VolumeMode != nil {
+		volume.VolumeMode = string(*spec.VolumeMode)
+	}
+
+	if contentType, ok := meta.Annotations[contentTypeAnnotation]; ok && contentType != "" {
+		volume.ContentType = contentType
+	}
+	return volume
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "<none>"
+	}
+	return value
+}
@@ -0,0 +1,199 @@
+package volumesnapshot
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/codingben/kubevirt-disk-uploader/pkg/ownerreference"
+
+	snapshotv1 "github.com/kubernetes-csi/external-snapshotter/client/v4/apis/volumesnapshot/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+
+	kubecli "kubevirt.io/client-go/kubecli"
+)
+
+const (
+	defaultStorageClassAnnotation string = "storageclass.kubernetes.io/is-default-class"
+)
+
+// CreatePersistentVolumeClaim creates a temporary PVC restored from the VolumeSnapshot,
+// with the storage class and size matching the snapshot, and returns its name. The name
+// is unique to the run of the owner, so concurrent runs don't collide.
+func CreatePersistentVolumeClaim(client kubecli.KubevirtClient, namespace, name string, owner *ownerreference.Owner) (string, error) {
+	snapshot, err := client.KubernetesSnapshotClient().SnapshotV1().VolumeSnapshots(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	if snapshot.Status == nil || snapshot.Status.ReadyToUse == nil || !*snapshot.Status.ReadyToUse {
+		return "", fmt.Errorf("VolumeSnapshot '%s/%s' is not ready to use", namespace, name)
+	}
+
+	sourcePvc, err := getSourcePersistentVolumeClaim(client, snapshot)
+	if err != nil {
+		return "", err
+	}
+
+	size, err := getRestoreSize(snapshot, sourcePvc)
+	if err != nil {
+		return "", err
+	}
+
+	storageClassName, err := getStorageClassName(client, snapshot, sourcePvc)
+	if err != nil {
+		return "", err
+	}
+
+	accessModes := []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}
+	var volumeMode *corev1.PersistentVolumeMode
+	if sourcePvc != nil {
+		accessModes = sourcePvc.Spec.AccessModes
+		volumeMode = sourcePvc.Spec.VolumeMode
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      GetPersistentVolumeClaimName(name, owner.RunID),
+			Namespace: namespace,
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes:      accessModes,
+			StorageClassName: storageClassName,
+			VolumeMode:       volumeMode,
+			DataSource: &corev1.TypedLocalObjectReference{
+				APIGroup: &snapshotv1.SchemeGroupVersion.Group,
+				Kind:     "VolumeSnapshot",
+				Name:     name,
+			},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: size,
+				},
+			},
+		},
+	}
+
+	ownerreference.SetOwnerReference(pvc, owner)
+
+	_, err = client.CoreV1().PersistentVolumeClaims(namespace).Create(context.Background(), pvc, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return pvc.Name, nil
+}
+
+// GetPersistentVolumeClaimName returns the name of the temporary PVC restored from the
+// VolumeSnapshot by the run. The snapshot name is shortened to fit the name of a PVC.
+func GetPersistentVolumeClaimName(snapshotName, runID string) string {
+	suffix := fmt.Sprintf("-restore-%s", runID)
+	if maxLength := validation.DNS1123SubdomainMaxLength - len(suffix); len(snapshotName) > maxLength {
+		snapshotName = strings.TrimRight(snapshotName[:maxLength], "-.")
+	}
+	return snapshotName + suffix
+}
+
+// GetVolumeName returns the name of the volume restored from the VolumeSnapshot. Unlike
+// the name of the PVC, it's the same in every run, e.g. for the image destination.
+func GetVolumeName(snapshotName string) string {
+	return fmt.Sprintf("%s-restore", snapshotName)
+}
+
+// ListPersistentVolumeClaims lists the temporary PVCs restored from the VolumeSnapshot
+// by previous runs. PVCs not created by the uploader are never listed.
+func ListPersistentVolumeClaims(client kubecli.KubevirtClient, namespace, snapshotName string) ([]corev1.PersistentVolumeClaim, error) {
+	selector := fmt.Sprintf("%s=%s", ownerreference.ManagedByLabel, ownerreference.ManagedByValue)
+	pvcs, err := client.CoreV1().PersistentVolumeClaims(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	var restoredPvcs []corev1.PersistentVolumeClaim
+	for _, pvc := range pvcs.Items {
+		dataSource := pvc.Spec.DataSource
+		if dataSource != nil && dataSource.Kind == "VolumeSnapshot" && dataSource.Name == snapshotName {
+			restoredPvcs = append(restoredPvcs, pvc)
+		}
+	}
+	return restoredPvcs, nil
+}
+
+func DeletePersistentVolumeClaim(client kubecli.KubevirtClient, namespace, name string) error {
+	err := client.CoreV1().PersistentVolumeClaims(namespace).Delete(context.Background(), name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func getSourcePersistentVolumeClaim(client kubecli.KubevirtClient, snapshot *snapshotv1.VolumeSnapshot) (*corev1.PersistentVolumeClaim, error) {
+	if snapshot.Spec.Source.PersistentVolumeClaimName == nil {
+		return nil, nil
+	}
+
+	pvc, err := client.CoreV1().PersistentVolumeClaims(snapshot.Namespace).Get(context.Background(), *snapshot.Spec.Source.PersistentVolumeClaimName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The source PVC may be deleted after the snapshot was taken.
+		return nil, nil
+	}
+	return pvc, err
+}
+
+func getRestoreSize(snapshot *snapshotv1.VolumeSnapshot, sourcePvc *corev1.PersistentVolumeClaim) (resource.Quantity, error) {
+	if snapshot.Status.RestoreSize != nil && !snapshot.Status.RestoreSize.IsZero() {
+		return *snapshot.Status.RestoreSize, nil
+	}
+
+	if sourcePvc != nil {
+		if size, ok := sourcePvc.Spec.Resources.Requests[corev1.ResourceStorage]; ok {
+			return size, nil
+		}
+	}
+	return resource.Quantity{}, fmt.Errorf("failed to get restore size of VolumeSnapshot '%s/%s'", snapshot.Namespace, snapshot.Name)
+}
+
+func getStorageClassName(client kubecli.KubevirtClient, snapshot *snapshotv1.VolumeSnapshot, sourcePvc *corev1.PersistentVolumeClaim) (*string, error) {
+	if sourcePvc != nil && sourcePvc.Spec.StorageClassName != nil {
+		return sourcePvc.Spec.StorageClassName, nil
+	}
+
+	if snapshot.Spec.VolumeSnapshotClassName == nil {
+		// Let the cluster pick the default storage class.
+		return nil, nil
+	}
+
+	snapshotClass, err := client.KubernetesSnapshotClient().SnapshotV1().VolumeSnapshotClasses().Get(context.Background(), *snapshot.Spec.VolumeSnapshotClassName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	storageClasses, err := client.StorageV1().StorageClasses().List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var storageClassName *string
+	for i := range storageClasses.Items {
+		storageClass := &storageClasses.Items[i]
+		if storageClass.Provisioner != snapshotClass.Driver {
+			continue
+		}
+
+		if storageClass.Annotations[defaultStorageClassAnnotation] == "true" {
+			return &storageClass.Name, nil
+		}
+
+		if storageClassName == nil {
+			storageClassName = &storageClass.Name
+		}
+	}
+
+	if storageClassName == nil {
+		return nil, fmt.Errorf("no storage class found for VolumeSnapshot driver '%s'", snapshotClass.Driver)
+	}
+	return storageClassName, nil
+}